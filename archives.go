@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveEntry describes a single log file stored in an archive
+type archiveEntry struct {
+	Index   int
+	Name    string
+	Size    int64
+	ModTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// Open returns the decompressed content of the entry; it is only valid inside the forEachArchiveEntry callback
+func (e archiveEntry) Open() (io.ReadCloser, error) {
+	return e.open()
+}
+
+// archiveKind classifies an archive by its file name
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar.zst"):
+		return "tar.zst"
+	case strings.HasSuffix(lower, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(lower, ".zst"):
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// forEachArchiveEntry calls fn for every entry of a zip, tar.gz or tar.zst archive, or for the single
+// file inside a gzip or zstd stream. Zip entries are only decompressed when the callback opens them;
+// the other formats are streamed in order.
+func forEachArchiveEntry(path string, fn func(e archiveEntry) error) error {
+	kind := archiveKind(path)
+	if kind == "zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for i, f := range zr.File {
+			f := f
+			e := archiveEntry{
+				Index:   i,
+				Name:    f.Name,
+				Size:    int64(f.UncompressedSize64),
+				ModTime: f.Modified,
+				open:    f.Open,
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var stream io.Reader
+	switch kind {
+	case "tar.gz", "gzip":
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		stream = gr
+	default:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		stream = zr
+	}
+
+	if kind == "gzip" || kind == "zstd" {
+		name := filepath.Base(path)
+		e := archiveEntry{
+			Name:    strings.TrimSuffix(name, filepath.Ext(name)),
+			Size:    -1,
+			ModTime: info.ModTime(),
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(stream), nil
+			},
+		}
+		return fn(e)
+	}
+
+	tr := tar.NewReader(stream)
+	for i := 0; ; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		e := archiveEntry{
+			Index:   i,
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			},
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		i++
+	}
+}
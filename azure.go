@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureAPIVersion = "2021-12-02" // the first version with the Cold access tier
+	azureAttempts   = 3
+	azureMaxBlocks  = 50000
+	azureMaxTagLen  = 256
+)
+
+// AzureConfig describes an Azure Blob Storage container
+type AzureConfig struct {
+	Account     string `json:"account"`       // storage account name, required
+	Endpoint    string `json:"endpoint"`      // defaults to https://<account>.blob.core.windows.net; Azurite: http://127.0.0.1:10000/devstoreaccount1
+	Container   string `json:"container"`     // required
+	AccountKey  string `json:"account_key"`   // shared key auth; defaults to AZURE_STORAGE_KEY
+	SASToken    string `json:"sas_token"`     // SAS auth instead of the account key; defaults to AZURE_STORAGE_SAS_TOKEN
+	Prefix      string `json:"prefix"`        // blob name prefix template, e.g. "iis/%h/%Y/%m/"
+	AccessTier  string `json:"access_tier"`   // "Hot", "Cool", "Cold" or "Archive"; empty for the account default
+	BlockSizeMB int    `json:"block_size_mb"` // default 8
+}
+
+// azureTarget uploads files as block blobs tagged with the site and period of the archive
+type azureTarget struct {
+	name      string
+	cfg       AzureConfig
+	endpoint  *url.URL
+	key       []byte
+	sas       url.Values
+	client    *http.Client
+	blockSize int64
+}
+
+// newAzureTarget validates the settings of an Azure Blob Storage target
+func newAzureTarget(name string, cfg AzureConfig) (*azureTarget, error) {
+	if cfg.Account == "" || cfg.Container == "" {
+		return nil, fmt.Errorf("azure.account and azure.container are required")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	if cfg.AccountKey == "" {
+		cfg.AccountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	if cfg.SASToken == "" {
+		cfg.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	t := &azureTarget{name: name, cfg: cfg}
+	switch {
+	case cfg.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("azure.sas_token: %v", err)
+		}
+		t.sas = sas
+	case cfg.AccountKey != "":
+		key, err := base64.StdEncoding.DecodeString(cfg.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("azure.account_key is not valid base64: %v", err)
+		}
+		t.key = key
+	default:
+		return nil, fmt.Errorf("azure credentials are missing (account_key or sas_token)")
+	}
+	switch strings.ToLower(cfg.AccessTier) {
+	case "":
+	case "hot", "cool", "cold", "archive":
+		t.cfg.AccessTier = strings.ToUpper(cfg.AccessTier[:1]) + strings.ToLower(cfg.AccessTier[1:])
+	default:
+		return nil, fmt.Errorf("azure.access_tier must be Hot, Cool, Cold or Archive, got %q", cfg.AccessTier)
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("azure.endpoint %q is not a valid URL", cfg.Endpoint)
+	}
+	t.endpoint = endpoint
+	t.blockSize = int64(cfg.BlockSizeMB) << 20
+	if t.blockSize <= 0 {
+		t.blockSize = 8 << 20
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 2 * time.Minute
+	t.client = &http.Client{Transport: transport}
+	return t, nil
+}
+
+// Name returns the configured target name
+func (t *azureTarget) Name() string {
+	return t.name
+}
+
+// Upload stages the file in blocks, commits the block list with access tier, index tags and the MD5 of
+// the whole file, and confirms size and MD5 with a HEAD request
+func (t *azureTarget) Upload(ctx context.Context, u remoteUpload) (string, error) {
+	blob := strings.TrimPrefix(expandRemotePrefix(t.cfg.Prefix, u)+u.Name, "/")
+	location := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(t.cfg.Endpoint, "/"), t.cfg.Container, blob)
+
+	f, err := os.Open(u.LocalPath)
+	if err != nil {
+		return location, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return location, err
+	}
+	size := info.Size()
+	blockSize := t.blockSize
+	if (size+blockSize-1)/blockSize > azureMaxBlocks {
+		blockSize = (size + azureMaxBlocks - 1) / azureMaxBlocks
+	}
+
+	// An empty file is committed as an empty block list
+	blocks := (size + blockSize - 1) / blockSize
+	whole := md5.New()
+	ids := make([]string, 0, blocks)
+	for i := int64(0); i < blocks; i++ {
+		offset := i * blockSize
+		n := blockSize
+		if offset+n > size {
+			n = size - offset
+		}
+		blockHash := md5.New()
+		if _, err := io.Copy(io.MultiWriter(blockHash, whole), io.NewSectionReader(f, offset, n)); err != nil {
+			return location, err
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", i)))
+		header := http.Header{}
+		header.Set("Content-MD5", encodeBase64(blockHash.Sum(nil)))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		resp, err := t.request(ctx, http.MethodPut, blob, query, header, sectionBody(f, offset, n), n)
+		if err != nil {
+			return location, fmt.Errorf("put block %d: %v", i, err)
+		}
+		resp.Body.Close()
+		ids = append(ids, id)
+	}
+	sum := whole.Sum(nil)
+
+	var list bytes.Buffer
+	list.WriteString(xml.Header + "<BlockList>")
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	body := list.Bytes()
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	header.Set("X-Ms-Blob-Content-Md5", encodeBase64(sum))
+	if t.cfg.AccessTier != "" {
+		header.Set("X-Ms-Access-Tier", t.cfg.AccessTier)
+	}
+	if tags := azureTags(u); tags != "" {
+		header.Set("X-Ms-Tags", tags)
+	}
+	resp, err := t.request(ctx, http.MethodPut, blob, url.Values{"comp": {"blocklist"}}, header,
+		func() io.Reader { return bytes.NewReader(body) }, int64(len(body)))
+	if err != nil {
+		return location, fmt.Errorf("put block list: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = t.request(ctx, http.MethodHead, blob, nil, nil, nil, 0)
+	if err != nil {
+		return location, fmt.Errorf("confirm upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != size {
+		return location, fmt.Errorf("confirm upload: remote size %d, local size %d", resp.ContentLength, size)
+	}
+	if got := resp.Header.Get("Content-MD5"); got != encodeBase64(sum) {
+		return location, fmt.Errorf("confirm upload: remote MD5 %s, expected %s", got, encodeBase64(sum))
+	}
+	return location, nil
+}
+
+// azureTags encodes the blob index tags: the site folders of the archive and its period (group key).
+// Tag values may not contain commas, so several sites are separated by spaces.
+func azureTags(u remoteUpload) string {
+	tags := url.Values{}
+	if len(u.Sites) > 0 {
+		sites := strings.Join(u.Sites, " ")
+		if len(sites) > azureMaxTagLen {
+			sites = sites[:azureMaxTagLen]
+		}
+		tags.Set("site", sites)
+	}
+	if u.Group != "" {
+		tags.Set("period", u.Group)
+	}
+	return strings.ReplaceAll(tags.Encode(), "+", "%20")
+}
+
+// request sends an authorised request for a blob, retrying network errors and 5xx/429 responses
+func (t *azureTarget) request(ctx context.Context, method, blob string, query url.Values, header http.Header, body func() io.Reader, size int64) (*http.Response, error) {
+	var lastErr error
+	for attempt := 1; attempt <= azureAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, time.Duration(attempt-1)*2*time.Second); err != nil {
+				return nil, err
+			}
+		}
+		req, err := t.newRequest(ctx, method, blob, query, header, body, size)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = withoutURL(err)
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if perr := parseStorageError(data); perr != nil {
+			lastErr = fmt.Errorf("%s: %v", resp.Status, perr)
+		} else if code := resp.Header.Get("X-Ms-Error-Code"); code != "" {
+			lastErr = fmt.Errorf("%s: %s", resp.Status, code)
+		} else {
+			lastErr = fmt.Errorf("%s", resp.Status)
+		}
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// newRequest builds a request for a blob and signs it with the shared key, or appends the SAS token
+func (t *azureTarget) newRequest(ctx context.Context, method, blob string, query url.Values, header http.Header, body func() io.Reader, size int64) (*http.Request, error) {
+	u := *t.endpoint
+	u.Path = strings.TrimSuffix(t.endpoint.Path, "/") + "/" + t.cfg.Container + "/" + blob
+	u.RawPath = s3Escape(u.Path, false)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range t.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	var r io.Reader
+	if body != nil {
+		r = body()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, withoutURL(err)
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if method == http.MethodPut && query.Get("comp") == "" {
+		req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+	if t.key != nil {
+		t.sign(req, query)
+	}
+	return req, nil
+}
+
+// sign adds the SharedKey Authorization header
+func (t *azureTarget) sign(req *http.Request, query url.Values) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var ms []string
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			ms = append(ms, lk+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(ms)
+
+	resource := "/" + t.cfg.Account + req.URL.EscapedPath()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, strings.ToLower(k))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		resource += "\n" + k + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(ms, "\n"),
+		resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+t.cfg.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// azuriteAccountKey is the well-known key of the Azurite development account devstoreaccount1
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureAccessTier(t *testing.T) {
+	tests := []struct {
+		tier    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"hot", "Hot", false},
+		{"COOL", "Cool", false},
+		{"Cold", "Cold", false},
+		{"archive", "Archive", false},
+		{"premium", "", true},
+	}
+	for _, tt := range tests {
+		target, err := newAzureTarget("test", AzureConfig{Account: "acct", Container: "logs", AccountKey: azuriteAccountKey, AccessTier: tt.tier})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("access_tier %q: error = %v, want error %v", tt.tier, err, tt.wantErr)
+			continue
+		}
+		if err == nil && target.cfg.AccessTier != tt.want {
+			t.Errorf("access_tier %q = %q, want %q", tt.tier, target.cfg.AccessTier, tt.want)
+		}
+	}
+}
+
+func TestAzureTags(t *testing.T) {
+	tests := []struct {
+		name string
+		u    remoteUpload
+		want string
+	}{
+		{"none", remoteUpload{}, ""},
+		{"period", remoteUpload{Group: "2024-05"}, "period=2024-05"},
+		{"sites", remoteUpload{Group: "2024-05", Sites: []string{"W3SVC1", "W3SVC2"}}, "period=2024-05&site=W3SVC1%20W3SVC2"},
+	}
+	for _, tt := range tests {
+		if got := azureTags(tt.u); got != tt.want {
+			t.Errorf("%s: azureTags = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeBlobService keeps staged blocks and committed blobs in memory, like the Blob service for the
+// requests Upload makes
+type fakeBlobService struct {
+	t      *testing.T
+	mu     sync.Mutex
+	blocks map[string][]byte
+	blob   []byte
+	header http.Header // headers of the Put Block List request
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if got := r.Header.Get("X-Ms-Version"); got != azureAPIVersion {
+		f.t.Errorf("x-ms-version = %q, want %q", got, azureAPIVersion)
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey acct:") {
+		f.t.Errorf("%s %s is not signed with the shared key", r.Method, r.URL)
+	}
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		data, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(data)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blocks[q.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blob = nil
+		for _, id := range list.Latest {
+			f.blob = append(f.blob, f.blocks[id]...)
+		}
+		f.header = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && f.header != nil:
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.blob)))
+		w.Header().Set("Content-MD5", f.header.Get("X-Ms-Blob-Content-Md5"))
+	default:
+		w.Header().Set("X-Ms-Error-Code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAzureUpload(t *testing.T) {
+	fake := &fakeBlobService{t: t, blocks: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	target, err := newAzureTarget("test", AzureConfig{
+		Account:     "acct",
+		Endpoint:    srv.URL + "/acct",
+		Container:   "logs",
+		AccountKey:  azuriteAccountKey,
+		Prefix:      "iis/%h/",
+		AccessTier:  "cold",
+		BlockSizeMB: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(t.TempDir(), "u_ex2405.zip")
+	data := make([]byte, 2<<20+12345) // three blocks
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	u := remoteUpload{LocalPath: local, Name: "u_ex2405.zip", Group: "2024-05", Host: "web01", Sites: []string{"W3SVC1"}}
+	location, err := target.Upload(context.Background(), u)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if want := srv.URL + "/acct/logs/iis/web01/u_ex2405.zip"; location != want {
+		t.Errorf("location = %s, want %s", location, want)
+	}
+	if len(fake.blocks) != 3 {
+		t.Errorf("%d blocks staged, want 3", len(fake.blocks))
+	}
+	if string(fake.blob) != string(data) {
+		t.Error("committed blob differs from the local file")
+	}
+	if got := fake.header.Get("X-Ms-Access-Tier"); got != "Cold" {
+		t.Errorf("x-ms-access-tier = %q, want Cold", got)
+	}
+	if got := fake.header.Get("X-Ms-Tags"); got != "period=2024-05&site=W3SVC1" {
+		t.Errorf("x-ms-tags = %q", got)
+	}
+}
+
+func TestAzureErrorHidesSASToken(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // refuse connections
+	target, err := newAzureTarget("test", AzureConfig{Account: "acct", Endpoint: srv.URL + "/acct", Container: "logs", SASToken: "?sv=2022-11-02&sig=c2VjcmV0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := target.newRequest(context.Background(), http.MethodHead, "u_ex2405.zip", nil, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.client.Do(req)
+	if err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+	if msg := withoutURL(err).Error(); strings.Contains(msg, "sig=") || strings.Contains(msg, "c2VjcmV0") {
+		t.Errorf("error %q contains the SAS token", msg)
+	}
+}
+
+// TestAzureAzurite uploads to the Azurite emulator. It runs when IISLC_TEST_AZURE_ENDPOINT is set, e.g.
+// against Azurite started with
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//
+// and IISLC_TEST_AZURE_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1 IISLC_TEST_AZURE_CONTAINER=<existing
+// container>. The account defaults to devstoreaccount1 with its well-known key.
+func TestAzureAzurite(t *testing.T) {
+	endpoint := os.Getenv("IISLC_TEST_AZURE_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("IISLC_TEST_AZURE_ENDPOINT is not set")
+	}
+	account := os.Getenv("IISLC_TEST_AZURE_ACCOUNT")
+	key := os.Getenv("AZURE_STORAGE_KEY")
+	if account == "" {
+		account, key = "devstoreaccount1", azuriteAccountKey
+	}
+	target, err := newAzureTarget("azurite", AzureConfig{
+		Account:     account,
+		Endpoint:    endpoint,
+		Container:   os.Getenv("IISLC_TEST_AZURE_CONTAINER"),
+		AccountKey:  key,
+		Prefix:      "iislc-test/%h/%Y/%m/",
+		AccessTier:  os.Getenv("IISLC_TEST_AZURE_TIER"),
+		BlockSizeMB: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(t.TempDir(), "u_ex2405.zip")
+	data := make([]byte, 3<<20+1)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u := remoteUpload{LocalPath: local, Name: "u_ex2405.zip", Group: "2024-05", Period: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), Host: "web01", Sites: []string{"W3SVC1", "W3SVC2"}}
+	if _, err := target.Upload(context.Background(), u); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+}
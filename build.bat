@@ -8,7 +8,7 @@ go mod tidy
 
 REM Build for Windows
 echo Building executable...
-go build -o iis-log-compressor.exe main.go
+go build -o iis-log-compressor.exe .
 
 if %ERRORLEVEL% EQU 0 (
     echo.
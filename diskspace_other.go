@@ -0,0 +1,10 @@
+//go:build !windows && !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskSpace is not implemented on this platform; the free space metrics are omitted
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space is not supported on this platform")
+}
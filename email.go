@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// addressList is a list of email addresses; in the config it is either a JSON array or a single string
+// with comma or semicolon separated addresses (the older "to" format)
+type addressList []string
+
+func (l *addressList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("expected an address or a list of addresses")
+		}
+		list = strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' })
+	}
+	*l = nil
+	for _, a := range list {
+		if a = strings.TrimSpace(a); a != "" {
+			*l = append(*l, a)
+		}
+	}
+	return nil
+}
+
+// EmailRoute sends the email for runs with one of the listed statuses to its own recipients
+type EmailRoute struct {
+	On  []string    `json:"on"` // "success", "warnings", "failed" and/or "cancelled"
+	To  addressList `json:"to"`
+	Cc  addressList `json:"cc"`
+	Bcc addressList `json:"bcc"`
+}
+
+// emailRecipients are the parsed recipients of one email
+type emailRecipients struct {
+	To, Cc, Bcc []*mail.Address
+}
+
+// envelope returns the SMTP recipients: to, cc and bcc
+func (r emailRecipients) envelope() []string {
+	var out []string
+	for _, list := range [][]*mail.Address{r.To, r.Cc, r.Bcc} {
+		for _, a := range list {
+			out = append(out, a.Address)
+		}
+	}
+	return out
+}
+
+// formatAddresses renders addresses for a message header
+func formatAddresses(list []*mail.Address) string {
+	parts := make([]string, len(list))
+	for i, a := range list {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseAddresses parses every entry of a configured address list
+func parseAddresses(field string, list addressList) ([]*mail.Address, error) {
+	var out []*mail.Address
+	for _, s := range list {
+		a, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid address %q: %v", field, s, err)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// validateEmailRouting checks the recipients, only_on and routes
+func validateEmailRouting(e *EmailConfig) error {
+	e.OnlyOn = strings.ToLower(strings.TrimSpace(e.OnlyOn))
+	switch e.OnlyOn {
+	case "":
+		e.OnlyOn = "always"
+	case "always", "warnings":
+	case "failure", "failed":
+		e.OnlyOn = "failure"
+	default:
+		return fmt.Errorf("email_notification.only_on must be \"always\", \"warnings\" or \"failure\", got %q", e.OnlyOn)
+	}
+	if !e.Enabled {
+		return nil
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return fmt.Errorf("email_notification.from: invalid address %q: %v", e.From, err)
+	}
+	lists := map[string]addressList{"to": e.To, "cc": e.Cc, "bcc": e.Bcc}
+	for i := range e.Routes {
+		r := &e.Routes[i]
+		if len(r.On) == 0 {
+			return fmt.Errorf("email_notification.routes[%d].on is required", i)
+		}
+		for j, s := range r.On {
+			switch s = strings.ToLower(strings.TrimSpace(s)); s {
+			case "success", "warnings", "failed", "cancelled":
+			case "failure":
+				s = "failed"
+			default:
+				return fmt.Errorf("email_notification.routes[%d].on must contain \"success\", \"warnings\", \"failed\" or \"cancelled\", got %q", i, s)
+			}
+			r.On[j] = s
+		}
+		lists[fmt.Sprintf("routes[%d].to", i)] = r.To
+		lists[fmt.Sprintf("routes[%d].cc", i)] = r.Cc
+		lists[fmt.Sprintf("routes[%d].bcc", i)] = r.Bcc
+	}
+	for field, list := range lists {
+		if _, err := parseAddresses("email_notification."+field, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectEmailRecipients applies only_on and the routes to a run status. The first route listing the status
+// replaces to, cc and bcc; without a match the top-level recipients are used. A non-empty reason means
+// no email is sent.
+func selectEmailRecipients(e EmailConfig, status string) (emailRecipients, string) {
+	var r emailRecipients
+	switch {
+	case e.OnlyOn == "failure" && status != "failed" && status != "cancelled":
+		return r, fmt.Sprintf("only_on is %q and the run status is %q", e.OnlyOn, status)
+	case e.OnlyOn == "warnings" && status == "success":
+		return r, fmt.Sprintf("only_on is %q and the run status is %q", e.OnlyOn, status)
+	}
+	to, cc, bcc := e.To, e.Cc, e.Bcc
+	for _, route := range e.Routes {
+		if containsString(route.On, status) {
+			to, cc, bcc = route.To, route.Cc, route.Bcc
+			break
+		}
+	}
+	// Addresses were checked by validateEmailRouting
+	r.To, _ = parseAddresses("to", to)
+	r.Cc, _ = parseAddresses("cc", cc)
+	r.Bcc, _ = parseAddresses("bcc", bcc)
+	if len(r.envelope()) == 0 {
+		return r, fmt.Sprintf("no recipients for %q runs", status)
+	}
+	return r, ""
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//go:embed templates/email.html templates/email.txt
+var emailTemplateFS embed.FS
+
+var (
+	emailHTMLTemplate *htmltemplate.Template
+	emailTextTemplate *texttemplate.Template
+)
+
+// emailTemplateFuncs are available to both email templates
+var emailTemplateFuncs = map[string]interface{}{
+	"mb":      func(n int64) string { return fmt.Sprintf("%.2f MB", float64(n)/(1024*1024)) },
+	"top":     formatTop,
+	"rfc3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"join":    strings.Join,
+	"repeat":  strings.Repeat,
+}
+
+// emailData is the data passed to the email templates
+type emailData struct {
+	*RunSummary
+	Subject     string
+	StatusLabel string
+	Duration    time.Duration
+	CPUCount    int
+	GOMAXPROCS  int
+	Attachments []string
+}
+
+// emailAttachment is a file attached to the notification
+type emailAttachment struct {
+	Name string
+	Data []byte
+}
+
+// loadEmailTemplates parses html_template and text_template, falling back to the built-in templates
+func loadEmailTemplates(e EmailConfig) error {
+	read := func(path, builtin string) (string, error) {
+		if path == "" {
+			data, err := emailTemplateFS.ReadFile(builtin)
+			return string(data), err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("email template: %v", err)
+		}
+		return string(data), nil
+	}
+	src, err := read(e.HTMLTemplate, "templates/email.html")
+	if err != nil {
+		return err
+	}
+	h, err := htmltemplate.New("html").Funcs(emailTemplateFuncs).Parse(src)
+	if err != nil {
+		return fmt.Errorf("email_notification.html_template: %v", err)
+	}
+	src, err = read(e.TextTemplate, "templates/email.txt")
+	if err != nil {
+		return err
+	}
+	t, err := texttemplate.New("text").Funcs(emailTemplateFuncs).Parse(src)
+	if err != nil {
+		return fmt.Errorf("email_notification.text_template: %v", err)
+	}
+	emailHTMLTemplate, emailTextTemplate = h, t
+	return nil
+}
+
+// emailSubject is e.g. "Success - IIS backup myhost.domain", followed by the configured subject if any
+func emailSubject(s *RunSummary) string {
+	subject := s.title()
+	if custom := strings.TrimSpace(config.EmailNotification.Subject); custom != "" {
+		subject += " - " + custom
+	}
+	return subject
+}
+
+// emailAttachments collects the run report and the manifests of this run, as configured. Files that would
+// take the total over max_attachment_mb are left out and listed as skipped.
+func emailAttachments(e EmailConfig) (attachments []emailAttachment, skipped []string) {
+	var candidates []emailAttachment
+	if e.AttachReport {
+		candidates = append(candidates, emailAttachment{Name: runReportName(), Data: []byte(runReportText())})
+	}
+	if e.AttachManifests {
+		for _, m := range stats.Manifests {
+			data, err := json.MarshalIndent(m, "", "  ")
+			if err != nil {
+				continue
+			}
+			candidates = append(candidates, emailAttachment{Name: m.Archive + manifestExtension, Data: data})
+		}
+	}
+	limit := int64(e.MaxAttachmentMB) * 1024 * 1024
+	var total int64
+	for _, a := range candidates {
+		if total+int64(len(a.Data)) > limit {
+			skipped = append(skipped, a.Name)
+			continue
+		}
+		total += int64(len(a.Data))
+		attachments = append(attachments, a)
+	}
+	return attachments, skipped
+}
+
+// sendEmailNotification renders the templates and sends a multipart/alternative message with a plain-text
+// and an HTML part, plus the configured attachments
+func sendEmailNotification(ctx context.Context, rcpts emailRecipients) error {
+	e := config.EmailNotification
+	summary := newRunSummary()
+	attachments, skipped := emailAttachments(e)
+	for _, name := range skipped {
+		logger.Warn("attachment skipped, max_attachment_mb reached", "name", name, "max_attachment_mb", e.MaxAttachmentMB)
+	}
+	data := emailData{
+		RunSummary:  summary,
+		Subject:     emailSubject(summary),
+		StatusLabel: statusLabel(summary.Status),
+		Duration:    stats.EndTime.Sub(stats.StartTime),
+		CPUCount:    runtime.NumCPU(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+	}
+	for _, a := range attachments {
+		data.Attachments = append(data.Attachments, a.Name)
+	}
+
+	var text, html bytes.Buffer
+	if err := emailTextTemplate.Execute(&text, data); err != nil {
+		return fmt.Errorf("text template: %v", err)
+	}
+	if err := emailHTMLTemplate.Execute(&html, data); err != nil {
+		return fmt.Errorf("html template: %v", err)
+	}
+
+	msg, err := buildEmailMessage(e.From, rcpts, data.Subject, text.String(), html.String(), attachments)
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(e.From)
+	return sendMail(ctx, e, from.Address, rcpts.envelope(), msg)
+}
+
+// buildEmailMessage assembles the MIME message. The text and HTML bodies form a multipart/alternative
+// part, which is wrapped in multipart/mixed when there are attachments.
+func buildEmailMessage(from string, rcpts emailRecipients, subject, text, html string, attachments []emailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	header("From", sender.String())
+	if len(rcpts.To) > 0 {
+		header("To", formatAddresses(rcpts.To))
+	} else {
+		header("To", "undisclosed-recipients:;")
+	}
+	if len(rcpts.Cc) > 0 {
+		header("Cc", formatAddresses(rcpts.Cc))
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	domain := "localhost"
+	if i := strings.LastIndex(sender.Address, "@"); i >= 0 {
+		domain = sender.Address[i+1:]
+	}
+	header("Message-ID", fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), domain))
+	header("MIME-Version", "1.0")
+
+	var body bytes.Buffer
+	alt := multipart.NewWriter(&body)
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := alt.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(p.body, "\r\n", "\n"), "\n", "\r\n"))); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+	altType := "multipart/alternative; boundary=" + alt.Boundary()
+	if len(attachments) == 0 {
+		header("Content-Type", altType)
+		buf.WriteString("\r\n")
+		buf.Write(body.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+	w, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {altType}})
+	if err != nil {
+		return nil, err
+	}
+	w.Write(body.Bytes())
+	for _, a := range attachments {
+		contentType := mime.TypeByExtension(filepath.Ext(a.Name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		for len(enc) > 76 {
+			io.WriteString(w, enc[:76]+"\r\n")
+			enc = enc[76:]
+		}
+		io.WriteString(w, enc+"\r\n")
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
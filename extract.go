@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"iis-log-compressor/iislog"
+)
+
+// iisLogNamePattern matches IIS log file names such as u_ex240503.log (daily), u_ex24050310.log (hourly) or u_ex2405.log (monthly)
+var iisLogNamePattern = regexp.MustCompile(`(?i)^(?:u_)?(?:ex|in|nc)(\d{4}|\d{6}|\d{8})(?:_x)?\.log$`)
+
+// logSpan returns the UTC time range covered by a log file, derived from its IIS name or,
+// failing that, from its modification time (assumed to be the last write of a daily file)
+func logSpan(name string, modTime time.Time) (time.Time, time.Time) {
+	if m := iisLogNamePattern.FindStringSubmatch(filepath.Base(name)); m != nil {
+		digits := m[1]
+		switch len(digits) {
+		case 4:
+			if t, err := time.Parse("0601", digits); err == nil {
+				return t, t.AddDate(0, 1, 0)
+			}
+		case 6:
+			if t, err := time.Parse("060102", digits); err == nil {
+				return t, t.AddDate(0, 0, 1)
+			}
+		case 8:
+			if t, err := time.Parse("06010215", digits); err == nil {
+				return t, t.Add(time.Hour)
+			}
+		}
+	}
+	end := modTime.UTC()
+	return end.Add(-24 * time.Hour), end
+}
+
+// parseTimeFlag accepts 2006-01-02, 2006-01-02T15:04 or 2006-01-02T15:04:05 in UTC.
+// A date-only value used as an upper bound covers the whole day.
+func parseTimeFlag(value string, upper bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if upper {
+			return t.AddDate(0, 0, 1), nil
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use 2006-01-02, 2006-01-02T15:04 or 2006-01-02T15:04:05)", value)
+}
+
+// trimLog copies W3C directive lines and the records whose date/time fall in [from, to).
+// The log format is detected from the content. It returns the number of records written.
+func trimLog(r io.Reader, w io.Writer, from, to time.Time) (int, error) {
+	bw := bufio.NewWriter(w)
+	lr := iislog.NewReader(r)
+	lr.OnDirective = func(line string) {
+		bw.WriteString(line)
+		bw.WriteString("\n")
+	}
+	written := 0
+	for lr.Next() {
+		rec := lr.Record()
+		if rec.Time.IsZero() || rec.Time.Before(from) || !rec.Time.Before(to) {
+			continue
+		}
+		bw.WriteString(rec.Line())
+		bw.WriteString("\n")
+		written++
+	}
+	if err := lr.Err(); err != nil {
+		return written, err
+	}
+	return written, bw.Flush()
+}
+
+// runExtract implements the extract subcommand and returns the process exit code
+func runExtract(args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	site := fs.String("site", "", "only extract logs of this site folder (e.g. W3SVC2)")
+	fromFlag := fs.String("from", "", "start of the time range in UTC (inclusive)")
+	toFlag := fs.String("to", "", "end of the time range in UTC (exclusive; a date-only value includes that day)")
+	outDir := fs.String("out", "", "folder to restore the logs into")
+	trim := fs.Bool("trim", false, "keep only log lines whose date/time fall in the range")
+	_ = fs.Parse(args)
+
+	if *outDir == "" {
+		fmt.Println("extract: -out is required")
+		return exitInvalidConfig
+	}
+	from := time.Time{}
+	to := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if *fromFlag != "" {
+		t, err := parseTimeFlag(*fromFlag, false)
+		if err != nil {
+			fmt.Printf("extract: -from: %v\n", err)
+			return exitInvalidConfig
+		}
+		from = t
+	}
+	if *toFlag != "" {
+		t, err := parseTimeFlag(*toFlag, true)
+		if err != nil {
+			fmt.Printf("extract: -to: %v\n", err)
+			return exitInvalidConfig
+		}
+		to = t
+	}
+	if !from.Before(to) {
+		fmt.Println("extract: -from must be before -to")
+		return exitInvalidConfig
+	}
+
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		return exitInvalidConfig
+	}
+	archives, err := findArchives(config.DestFolder)
+	if err != nil {
+		fmt.Printf("Failed to scan %s: %v\n", config.DestFolder, err)
+		return exitFailed
+	}
+
+	extracted, failures := 0, 0
+	targets := make(map[string]string) // files written by this run, to the archive they came from
+	for _, archivePath := range archives {
+		// Sites are only known for archives that carry a manifest
+		sites := make(map[int]string)
+		manifest, err := readManifest(archivePath)
+		if err == nil {
+			// The manifest tells which archives hold nothing of the range without decompressing them
+			if !manifestSelects(manifest, *site, from, to) {
+				continue
+			}
+			for _, me := range manifest.Entries {
+				sites[me.Index] = me.Site
+			}
+		} else if *site != "" {
+			fmt.Printf("Skipping %s: no manifest to tell sites apart\n", archivePath)
+			continue
+		} else if kind := archiveKind(archivePath); kind == "gzip" || kind == "zstd" {
+			// A single compressed log is named after it
+			if info, err := os.Stat(archivePath); err == nil {
+				name := filepath.Base(archivePath)
+				start, end := logSpan(strings.TrimSuffix(name, filepath.Ext(name)), info.ModTime())
+				if !start.Before(to) || !end.After(from) {
+					continue
+				}
+			}
+		}
+
+		err = forEachArchiveEntry(archivePath, func(e archiveEntry) error {
+			entrySite := sites[e.Index]
+			if *site != "" && !strings.EqualFold(entrySite, *site) {
+				return nil
+			}
+			start, end := logSpan(e.Name, e.ModTime)
+			if !start.Before(to) || !end.After(from) {
+				return nil
+			}
+
+			targetDir := *outDir
+			if entrySite != "" {
+				targetDir = filepath.Join(targetDir, entrySite)
+			}
+			target := uniqueTarget(targets, targetDir, filepath.Base(e.Name), archivePath)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			rc, err := e.Open()
+			if err != nil {
+				failures++
+				fmt.Printf("Warning: failed to open %s in %s: %v\n", e.Name, archivePath, err)
+				return nil
+			}
+			defer rc.Close()
+			out, err := os.Create(target)
+			if err != nil {
+				return err
+			}
+			lines := -1
+			if *trim {
+				lines, err = trimLog(rc, out, from, to)
+			} else {
+				_, err = io.Copy(out, rc)
+			}
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				failures++
+				_ = os.Remove(target)
+				fmt.Printf("Warning: failed to extract %s from %s: %v\n", e.Name, archivePath, err)
+				return nil
+			}
+			if lines == 0 {
+				_ = os.Remove(target)
+				return nil
+			}
+			targets[target] = archivePath
+			extracted++
+			if lines > 0 {
+				fmt.Printf("Extracted %s -> %s (%d lines)\n", e.Name, target, lines)
+			} else {
+				fmt.Printf("Extracted %s -> %s\n", e.Name, target)
+			}
+			return nil
+		})
+		if err != nil {
+			failures++
+			fmt.Printf("Warning: failed to read %s: %v\n", archivePath, err)
+		}
+	}
+
+	fmt.Printf("\nExtracted %d log files to %s", extracted, *outDir)
+	if failures > 0 {
+		fmt.Printf(" (%d failures)\n", failures)
+		return exitFailed
+	}
+	fmt.Println()
+	return exitSuccess
+}
+
+// manifestSelects reports whether an archive holds a log of the site (any site if empty) that may contain
+// records in [from, to)
+func manifestSelects(m *Manifest, site string, from, to time.Time) bool {
+	for _, me := range m.Entries {
+		if site != "" && !strings.EqualFold(me.Site, site) {
+			continue
+		}
+		if start, end := logSpan(me.Name, me.ModTime); start.Before(to) && end.After(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueTarget returns the path to extract a log named name into dir. Logs of the same name from different
+// archives, e.g. of different sites without a manifest, would overwrite each other, so a name already
+// written by this run moves into a subfolder named after the archive, with a number added if needed.
+func uniqueTarget(written map[string]string, dir, name, archivePath string) string {
+	target := filepath.Join(dir, name)
+	if _, ok := written[target]; !ok {
+		return target
+	}
+	archiveName := filepath.Base(archivePath)
+	archiveName = strings.TrimSuffix(strings.TrimSuffix(archiveName, filepath.Ext(archiveName)), ".tar")
+	alt := filepath.Join(dir, archiveName, name)
+	ext := filepath.Ext(name)
+	for n := 2; ; n++ {
+		if _, ok := written[alt]; !ok {
+			break
+		}
+		alt = filepath.Join(dir, archiveName, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), n, ext))
+	}
+	fmt.Printf("Note: %s was already extracted from %s, writing %s instead\n", target, written[target], alt)
+	return alt
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSpan(t *testing.T) {
+	modTime := time.Date(2024, 5, 4, 6, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"u_ex240503.log", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"W3SVC1/u_ex24050310.log", time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 11, 0, 0, 0, time.UTC)},
+		{"u_ex2405.log", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"EX240503_x.LOG", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"nc240503.log", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)},
+		// Other names cover the day before the last write
+		{"app.log", modTime.Add(-24 * time.Hour), modTime},
+		{"u_ex241399.log", modTime.Add(-24 * time.Hour), modTime},
+	}
+	for _, tt := range tests {
+		start, end := logSpan(tt.name, modTime)
+		if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+			t.Errorf("logSpan(%q) = %s - %s, want %s - %s", tt.name, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		upper   bool
+		want    time.Time
+		wantErr bool
+	}{
+		{"2024-05-03", false, time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), false},
+		{"2024-05-03", true, time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC), false},
+		{"2024-05-03T10:15", false, time.Date(2024, 5, 3, 10, 15, 0, 0, time.UTC), false},
+		{"2024-05-03T10:15", true, time.Date(2024, 5, 3, 10, 15, 0, 0, time.UTC), false},
+		{"2024-05-03T10:15:30", false, time.Date(2024, 5, 3, 10, 15, 30, 0, time.UTC), false},
+		{"2024-05-03 10:15:30", false, time.Date(2024, 5, 3, 10, 15, 30, 0, time.UTC), false},
+		{"03.05.2024", false, time.Time{}, true},
+		{"", false, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeFlag(tt.value, tt.upper)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimeFlag(%q, %v): error = %v, want error %v", tt.value, tt.upper, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTimeFlag(%q, %v) = %s, want %s", tt.value, tt.upper, got, tt.want)
+		}
+	}
+}
+
+func TestTrimLog(t *testing.T) {
+	input := "#Software: Microsoft Internet Information Services 10.0\r\n" +
+		"#Fields: date time cs-method cs-uri-stem sc-status\r\n" +
+		"2024-05-03 09:59:59 GET /a 200\r\n" +
+		"2024-05-03 10:00:00 GET /b 200\r\n" +
+		"2024-05-03 10:30:00 GET /c 404\r\n" +
+		"2024-05-03 11:00:00 GET /d 200\r\n"
+	tests := []struct {
+		name      string
+		from, to  time.Time
+		wantLines int
+		wantURIs  []string
+	}{
+		{"hour", time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 11, 0, 0, 0, time.UTC), 2, []string{"/b", "/c"}},
+		{"everything", time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), 4, []string{"/a", "/b", "/c", "/d"}},
+		{"nothing", time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			n, err := trimLog(strings.NewReader(input), &out, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.wantLines {
+				t.Errorf("%d records written, want %d", n, tt.wantLines)
+			}
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) < 2 || !strings.HasPrefix(lines[1], "#Fields:") {
+				t.Fatalf("directives not kept:\n%s", out.String())
+			}
+			var uris []string
+			for _, line := range lines[2:] {
+				uris = append(uris, strings.Fields(line)[3])
+			}
+			if strings.Join(uris, " ") != strings.Join(tt.wantURIs, " ") {
+				t.Errorf("records %v, want %v", uris, tt.wantURIs)
+			}
+		})
+	}
+}
+
+func TestUniqueTarget(t *testing.T) {
+	dir := "out"
+	written := make(map[string]string)
+	first := uniqueTarget(written, dir, "u_ex240503.log", "logs_2024-05.zip")
+	if first != filepath.Join(dir, "u_ex240503.log") {
+		t.Errorf("first target = %s", first)
+	}
+	written[first] = "logs_2024-05.zip"
+	second := uniqueTarget(written, dir, "u_ex240503.log", "other/logs_2024-05-b.tar.zst")
+	if second != filepath.Join(dir, "logs_2024-05-b", "u_ex240503.log") {
+		t.Errorf("second target = %s, want a subfolder named after the archive", second)
+	}
+	written[second] = "other/logs_2024-05-b.tar.zst"
+	third := uniqueTarget(written, dir, "u_ex240503.log", "other/logs_2024-05-b.tar.zst")
+	if third != filepath.Join(dir, "logs_2024-05-b", "u_ex240503_2.log") {
+		t.Errorf("third target = %s, want a numbered name", third)
+	}
+}
+
+func TestManifestSelects(t *testing.T) {
+	m := &Manifest{Entries: []ManifestEntry{
+		{Name: "u_ex240503.log", Site: "W3SVC1"},
+		{Name: "u_ex240504.log", Site: "W3SVC2"},
+	}}
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		site     string
+		from, to time.Time
+		want     bool
+	}{
+		{"", day(3), day(4), true},
+		{"", day(5), day(6), false},
+		{"w3svc2", day(4), day(5), true},
+		{"W3SVC2", day(3), day(4), false},
+		{"W3SVC3", day(1), day(9), false},
+	}
+	for _, tt := range tests {
+		if got := manifestSelects(m, tt.site, tt.from, tt.to); got != tt.want {
+			t.Errorf("manifestSelects(%q, %s, %s) = %v, want %v", tt.site, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
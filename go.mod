@@ -1,3 +1,22 @@
 module iis-log-compressor
 
 go 1.21
+
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/parquet-go/parquet-go v0.23.0
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/segmentio/encoding v0.4.0 // indirect
+)
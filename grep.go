@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"iis-log-compressor/iislog"
+)
+
+// fieldPredicatePattern matches field predicates such as c-ip=10.0.0.5, sc-status>=500 or cs-uri-stem~^/api/.
+// W3C field names are used for every log format.
+var fieldPredicatePattern = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9()_-]*)(!=|>=|<=|=|>|<|~)(.*)$`)
+
+// fieldPredicate is a single condition on a log field
+type fieldPredicate struct {
+	Field string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// parseFieldPredicate parses an argument such as sc-status>=500
+func parseFieldPredicate(arg string) (fieldPredicate, bool, error) {
+	m := fieldPredicatePattern.FindStringSubmatch(arg)
+	if m == nil {
+		return fieldPredicate{}, false, nil
+	}
+	p := fieldPredicate{Field: m[1], Op: m[2], Value: m[3]}
+	// "-" is how W3C writes null, which the parser decodes to ""
+	if p.Value == "-" {
+		p.Value = ""
+	}
+	if p.Op == "~" {
+		re, err := regexp.Compile(p.Value)
+		if err != nil {
+			return p, true, fmt.Errorf("predicate %s: %v", arg, err)
+		}
+		p.re = re
+	}
+	return p, true, nil
+}
+
+// match evaluates the predicate against a decoded field value. Ordering operators compare numerically
+// when both sides are numbers and fall back to string comparison otherwise.
+func (p fieldPredicate) match(value string) bool {
+	switch p.Op {
+	case "~":
+		return p.re.MatchString(value)
+	case "=":
+		return strings.EqualFold(value, p.Value)
+	case "!=":
+		return !strings.EqualFold(value, p.Value)
+	}
+	cmp := strings.Compare(value, p.Value)
+	if a, err := strconv.ParseFloat(value, 64); err == nil {
+		if b, err := strconv.ParseFloat(p.Value, 64); err == nil {
+			switch {
+			case a < b:
+				cmp = -1
+			case a > b:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+	switch p.Op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// errNoManifest is returned by grepArchive for archives that --site cannot search
+var errNoManifest = errors.New("no manifest to tell sites apart")
+
+// grepArchive streams every entry of an archive and sends matching lines as "archive:entry:line: text".
+// It also returns the predicate fields that no record of the archive has, so that a misspelt field is
+// reported rather than silently matching nothing. An entry that cannot be read is skipped and reported
+// in the error without stopping the search of the other entries.
+func grepArchive(archivePath, site string, re *regexp.Regexp, preds []fieldPredicate, out chan<- string) (int, []string, error) {
+	sites := make(map[int]string)
+	if site != "" {
+		manifest, err := readManifest(archivePath)
+		if err != nil {
+			return 0, nil, errNoManifest
+		}
+		for _, me := range manifest.Entries {
+			sites[me.Index] = me.Site
+		}
+	}
+
+	matches := 0
+	seen := make([]bool, len(preds))
+	var entryErrs []error
+	err := forEachArchiveEntry(archivePath, func(e archiveEntry) error {
+		if site != "" && !strings.EqualFold(sites[e.Index], site) {
+			return nil
+		}
+		rc, err := e.Open()
+		if err != nil {
+			entryErrs = append(entryErrs, fmt.Errorf("%s: %v", e.Name, err))
+			return nil
+		}
+		defer rc.Close()
+
+		if len(preds) > 0 {
+			lr := iislog.NewReader(rc)
+			for lr.Next() {
+				rec := lr.Record()
+				for i, p := range preds {
+					if !seen[i] && rec.Has(p.Field) {
+						seen[i] = true
+					}
+				}
+				if re != nil && !re.MatchString(rec.Line()) {
+					continue
+				}
+				ok := true
+				for _, p := range preds {
+					if !rec.Has(p.Field) || !p.match(rec.Get(p.Field)) {
+						ok = false
+						break
+					}
+				}
+				if !ok {
+					continue
+				}
+				matches++
+				out <- fmt.Sprintf("%s:%s:%d: %s", archivePath, e.Name, lr.Line(), rec.Line())
+			}
+			if err := lr.Err(); err != nil {
+				entryErrs = append(entryErrs, fmt.Errorf("%s: %v", e.Name, err))
+			}
+			return nil
+		}
+
+		sc := bufio.NewScanner(rc)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		lineNo := 0
+		for sc.Scan() {
+			lineNo++
+			line := sc.Text()
+			if !re.MatchString(line) {
+				continue
+			}
+			matches++
+			out <- fmt.Sprintf("%s:%s:%d: %s", archivePath, e.Name, lineNo, line)
+		}
+		if err := sc.Err(); err != nil {
+			entryErrs = append(entryErrs, fmt.Errorf("%s: %v", e.Name, err))
+		}
+		return nil
+	})
+
+	var missing []string
+	listed := make(map[string]bool)
+	for i, p := range preds {
+		if !seen[i] && !listed[p.Field] {
+			listed[p.Field] = true
+			missing = append(missing, p.Field)
+		}
+	}
+	return matches, missing, errors.Join(append(entryErrs, err)...)
+}
+
+// runGrep implements the grep subcommand and returns grep-style exit codes:
+// 0 when lines matched, 1 when nothing matched and 2 on errors, except that a config that cannot be
+// loaded returns exitInvalidConfig like the other subcommands
+func runGrep(args []string) int {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	expr := fs.String("e", "", "regular expression to match against whole lines")
+	ignoreCase := fs.Bool("i", false, "case-insensitive regular expression")
+	site := fs.String("site", "", "only search logs of this site folder (e.g. W3SVC2)")
+	jobs := fs.Int("j", runtime.GOMAXPROCS(0), "number of archives searched in parallel")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: grep [flags] [regex] [field<op>value ...]")
+		fmt.Fprintln(os.Stderr, "  operators: = != > >= < <= ~ (regex), e.g. c-ip=10.0.0.5 sc-status>=500")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	pattern := *expr
+	var preds []fieldPredicate
+	for _, arg := range fs.Args() {
+		p, ok, err := parseFieldPredicate(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grep: %v\n", err)
+			return 2
+		}
+		if ok {
+			preds = append(preds, p)
+			continue
+		}
+		if pattern != "" {
+			fmt.Fprintf(os.Stderr, "grep: unexpected argument %q\n", arg)
+			return 2
+		}
+		pattern = arg
+	}
+	if pattern == "" && len(preds) == 0 {
+		fs.Usage()
+		return 2
+	}
+	var re *regexp.Regexp
+	if pattern != "" {
+		if *ignoreCase {
+			pattern = "(?i)" + pattern
+		}
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			fmt.Fprintf(os.Stderr, "grep: %v\n", err)
+			return 2
+		}
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return exitInvalidConfig
+	}
+	archives, err := findArchives(config.DestFolder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to scan %s: %v\n", config.DestFolder, err)
+		return 2
+	}
+
+	out := make(chan string, 256)
+	printed := make(chan struct{})
+	go func() {
+		w := bufio.NewWriter(os.Stdout)
+		for line := range out {
+			w.WriteString(line)
+			w.WriteString("\n")
+		}
+		_ = w.Flush()
+		close(printed)
+	}()
+
+	var wg sync.WaitGroup
+	var gmu sync.Mutex
+	semaphore := make(chan struct{}, *jobs)
+	total, failures, skipped := 0, 0, 0
+	// Archives searched without a record that has the field, by predicate field
+	missingIn := make(map[string]int)
+	for _, p := range archives {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			n, missing, err := grepArchive(p, *site, re, preds, out)
+			gmu.Lock()
+			defer gmu.Unlock()
+			total += n
+			if errors.Is(err, errNoManifest) {
+				skipped++
+				fmt.Fprintf(os.Stderr, "grep: skipping %s: %v\n", p, err)
+				return
+			}
+			if err != nil {
+				failures++
+				fmt.Fprintf(os.Stderr, "grep: %s: %v\n", p, err)
+			}
+			for _, field := range missing {
+				missingIn[field]++
+			}
+			if len(missing) > 0 {
+				fmt.Fprintf(os.Stderr, "grep: %s: no log has the field %s\n", p, strings.Join(missing, ", "))
+			}
+		}()
+	}
+	wg.Wait()
+	close(out)
+	<-printed
+
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%d matching lines in %d archives, %d skipped without manifest\n", total,
+			len(archives)-skipped, skipped)
+	} else {
+		fmt.Fprintf(os.Stderr, "%d matching lines in %d archives\n", total, len(archives))
+	}
+	// A field that no searched archive has is most likely misspelt
+	searched := len(archives) - skipped
+	for _, p := range preds {
+		if searched > 0 && missingIn[p.Field] == searched {
+			fmt.Fprintf(os.Stderr, "grep: no archive has the field %s\n", p.Field)
+			delete(missingIn, p.Field)
+			failures++
+		}
+	}
+	switch {
+	case failures > 0:
+		return 2
+	case total == 0:
+		return 1
+	}
+	return 0
+}
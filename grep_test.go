@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestParseFieldPredicate(t *testing.T) {
+	tests := []struct {
+		arg       string
+		wantOK    bool
+		wantErr   bool
+		wantField string
+		wantOp    string
+		wantValue string
+	}{
+		{"sc-status>=500", true, false, "sc-status", ">=", "500"},
+		{"c-ip=10.0.0.5", true, false, "c-ip", "=", "10.0.0.5"},
+		{"cs-uri-stem~^/api/", true, false, "cs-uri-stem", "~", "^/api/"},
+		{"cs(Referer)!=-", true, false, "cs(Referer)", "!=", ""},
+		{"time-taken<100", true, false, "time-taken", "<", "100"},
+		{"cs-uri-query~[", true, true, "", "", ""},
+		{"error", false, false, "", "", ""},
+		{"^GET /api", false, false, "", "", ""},
+	}
+	for _, tt := range tests {
+		p, ok, err := parseFieldPredicate(tt.arg)
+		if ok != tt.wantOK || (err != nil) != tt.wantErr {
+			t.Errorf("parseFieldPredicate(%q): ok = %v, error = %v, want ok %v, error %v", tt.arg, ok, err, tt.wantOK, tt.wantErr)
+			continue
+		}
+		if !ok || err != nil {
+			continue
+		}
+		if p.Field != tt.wantField || p.Op != tt.wantOp || p.Value != tt.wantValue {
+			t.Errorf("parseFieldPredicate(%q) = %s %s %q, want %s %s %q", tt.arg, p.Field, p.Op, p.Value,
+				tt.wantField, tt.wantOp, tt.wantValue)
+		}
+	}
+}
+
+func TestFieldPredicateMatch(t *testing.T) {
+	tests := []struct {
+		pred  string
+		value string
+		want  bool
+	}{
+		// Numbers compare numerically, not as strings
+		{"sc-status>=500", "503", true},
+		{"sc-status>=500", "404", false},
+		{"time-taken>20", "100", true},
+		{"time-taken<20", "100", false},
+		{"time-taken<=1.5", "1.50", true},
+		// Anything else compares as strings
+		{"cs-method>GET", "POST", true},
+		{"date<2024-05-03", "2024-05-02", true},
+		{"sc-status>=500", "abc", true},
+		// = and != ignore case
+		{"cs-method=get", "GET", true},
+		{"cs-method!=get", "GET", false},
+		// "-" stands for null, which the parser decodes to ""
+		{"cs-username=-", "", true},
+		{"cs-username!=-", "alice", true},
+		{"cs-username=-", "alice", false},
+		// ~ matches a regular expression anywhere in the value
+		{"cs-uri-stem~^/api/", "/api/orders", true},
+		{"cs-uri-stem~^/api/", "/static/api/x.js", false},
+		{"cs(User-Agent)~(?i)bot", "Googlebot/2.1", true},
+	}
+	for _, tt := range tests {
+		p, ok, err := parseFieldPredicate(tt.pred)
+		if !ok || err != nil {
+			t.Fatalf("parseFieldPredicate(%q): ok = %v, error = %v", tt.pred, ok, err)
+		}
+		if got := p.match(tt.value); got != tt.want {
+			t.Errorf("%s against %q = %v, want %v", tt.pred, tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestGrepArchive searches a zip with an entry that cannot be opened and a predicate on a misspelt field
+func TestGrepArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs_2024-05.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	// An entry with a compression method the reader does not support fails to open
+	bad, err := zw.CreateRaw(&zip.FileHeader{Name: "u_ex240502.log", Method: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write([]byte("garbage"))
+	w, err := zw.Create("u_ex240503.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("#Fields: date time cs-uri-stem sc-status\r\n" +
+		"2024-05-03 10:00:00 /a 200\r\n" +
+		"2024-05-03 10:00:01 /b 500\r\n" +
+		"2024-05-03 10:00:02 /c 503\r\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(args ...string) []fieldPredicate {
+		var preds []fieldPredicate
+		for _, arg := range args {
+			p, _, err := parseFieldPredicate(arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			preds = append(preds, p)
+		}
+		return preds
+	}
+	tests := []struct {
+		name        string
+		re          *regexp.Regexp
+		preds       []fieldPredicate
+		wantMatches int
+		wantMissing []string
+	}{
+		{"predicate", nil, parse("sc-status>=500"), 2, nil},
+		{"regex and predicate", regexp.MustCompile(`/c`), parse("sc-status>=500"), 1, nil},
+		{"regex only", regexp.MustCompile(`/a`), nil, 1, nil},
+		{"misspelt field", nil, parse("sc-stauts>=500", "sc-stauts<600"), 0, []string{"sc-stauts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make(chan string, 16)
+			n, missing, err := grepArchive(path, "", tt.re, tt.preds, out)
+			if err == nil {
+				t.Error("the entry that cannot be opened was not reported")
+			}
+			if n != tt.wantMatches || len(out) != tt.wantMatches {
+				t.Errorf("%d matches (%d lines), want %d", n, len(out), tt.wantMatches)
+			}
+			if len(missing) != len(tt.wantMissing) || (len(missing) > 0 && missing[0] != tt.wantMissing[0]) {
+				t.Errorf("missing fields %v, want %v", missing, tt.wantMissing)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryRecord is one line of the run history file (history_file), appended after every run
+type HistoryRecord struct {
+	Time             time.Time       `json:"time"` // end of the run
+	Host             string          `json:"host"`
+	Status           string          `json:"status"`
+	DurationSeconds  float64         `json:"duration_seconds"`
+	Groups           int             `json:"groups"`
+	FilesCompressed  int             `json:"files_compressed"`
+	BytesBefore      int64           `json:"bytes_before"`
+	BytesAfter       int64           `json:"bytes_after"`
+	CompressionRatio float64         `json:"compression_ratio_percent"`
+	ThroughputMBs    float64         `json:"throughput_mb_per_s"`
+	Errors           int             `json:"errors"`
+	Warnings         int             `json:"warnings"`
+	Sites            []HistoryVolume `json:"sites,omitempty"`
+}
+
+// HistoryVolume is the log volume of one site in one group (month or day)
+type HistoryVolume struct {
+	Group string `json:"group"`
+	Site  string `json:"site"` // "" for logs directly in source_folder
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SiteVolume is the size of the log files of one site found in a group
+type SiteVolume struct {
+	Site  string `json:"site"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// siteVolumes sums the log files of a group per site folder
+func siteVolumes(files []LogFile) []SiteVolume {
+	bySite := make(map[string]*SiteVolume)
+	var out []SiteVolume
+	for _, f := range files {
+		site := siteForPath(f.Path)
+		v := bySite[site]
+		if v == nil {
+			v = &SiteVolume{Site: site}
+			bySite[site] = v
+		}
+		v.Files++
+		v.Bytes += f.Size
+	}
+	for _, v := range bySite {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Site < out[j].Site })
+	return out
+}
+
+// newHistoryRecord captures the current stats as a history line
+func newHistoryRecord() HistoryRecord {
+	s := newRunSummary()
+	r := HistoryRecord{
+		Time:             s.EndTime,
+		Host:             s.Host,
+		Status:           s.Status,
+		DurationSeconds:  s.DurationSeconds,
+		Groups:           s.Groups,
+		FilesCompressed:  s.FilesCompressed,
+		BytesBefore:      s.BytesBefore,
+		BytesAfter:       s.BytesAfter,
+		CompressionRatio: s.CompressionRatio,
+		Errors:           len(s.Errors),
+		Warnings:         len(s.Warnings),
+	}
+	if s.DurationSeconds > 0 {
+		r.ThroughputMBs = float64(s.BytesBefore) / (1024 * 1024) / s.DurationSeconds
+	}
+	for _, g := range stats.Groups {
+		for _, v := range g.Sites {
+			r.Sites = append(r.Sites, HistoryVolume{Group: g.Group, Site: v.Site, Files: v.Files, Bytes: v.Bytes})
+		}
+	}
+	sort.Slice(r.Sites, func(i, j int) bool {
+		if r.Sites[i].Group != r.Sites[j].Group {
+			return r.Sites[i].Group < r.Sites[j].Group
+		}
+		return r.Sites[i].Site < r.Sites[j].Site
+	})
+	return r
+}
+
+// appendHistory appends the run to history_file as a single JSON line
+func appendHistory() error {
+	if config.HistoryFile == "" {
+		return nil
+	}
+	line, err := json.Marshal(newHistoryRecord())
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(config.HistoryFile); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(config.HistoryFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory loads the run history in file order; lines that cannot be parsed (e.g. a line cut short by a
+// crash) are skipped and counted
+func readHistory(path string) ([]HistoryRecord, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var records []HistoryRecord
+	bad := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var r HistoryRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			bad++
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, bad, sc.Err()
+}
+
+// runHistory implements the "history" subcommand: recent runs, failure streaks and log volume per site
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	file := fs.String("file", "", "history file (default: history_file from the configuration)")
+	last := fs.Int("last", 20, "number of recent runs to list")
+	site := fs.String("site", "", "only show the log volume of this site folder (e.g. W3SVC2)")
+	months := fs.Int("months", 12, "number of months of log volume to show per site")
+	_ = fs.Parse(args)
+
+	path := *file
+	if path == "" {
+		if err := loadConfig(*configPath); err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return exitInvalidConfig
+		}
+		path = config.HistoryFile
+	}
+	if path == "" {
+		fmt.Println("No history file: set \"history_file\" in the configuration or use -file")
+		return exitInvalidConfig
+	}
+	records, bad, err := readHistory(path)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", path, err)
+		return exitFailed
+	}
+	if bad > 0 {
+		fmt.Printf("Warning: skipped %d unreadable line(s) in %s\n", bad, path)
+	}
+	if len(records) == 0 {
+		fmt.Printf("No runs recorded in %s\n", path)
+		return exitSuccess
+	}
+
+	printHistoryRuns(records, *last)
+	printFailureStreaks(records)
+	printSiteVolumes(records, *site, *months)
+	return exitSuccess
+}
+
+// printHistoryRuns lists the most recent runs with their compression ratio and throughput
+func printHistoryRuns(records []HistoryRecord, last int) {
+	start := 0
+	if last > 0 && len(records) > last {
+		start = len(records) - last
+	}
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Printf("RUNS (%d of %d)\n", len(records)-start, len(records))
+	fmt.Println(strings.Repeat("=", 50))
+	fmt.Printf("%-16s  %-9s  %9s  %6s  %10s  %10s  %7s  %8s  %s\n",
+		"Time", "Status", "Duration", "Files", "Before MB", "After MB", "Ratio", "MB/s", "Err/Warn")
+	for _, r := range records[start:] {
+		fmt.Printf("%-16s  %-9s  %9s  %6d  %10.2f  %10.2f  %6.2f%%  %8.2f  %d/%d\n",
+			r.Time.Local().Format("2006-01-02 15:04"), r.Status,
+			(time.Duration(r.DurationSeconds * float64(time.Second))).Round(time.Second),
+			r.FilesCompressed, float64(r.BytesBefore)/(1024*1024), float64(r.BytesAfter)/(1024*1024),
+			r.CompressionRatio, r.ThroughputMBs, r.Errors, r.Warnings)
+	}
+
+	var before, after int64
+	var seconds float64
+	for _, r := range records {
+		before += r.BytesBefore
+		after += r.BytesAfter
+		seconds += r.DurationSeconds
+	}
+	if before > 0 {
+		fmt.Printf("All runs: %.2f MB -> %.2f MB, ratio %.2f%%", float64(before)/(1024*1024), float64(after)/(1024*1024),
+			float64(before-after)/float64(before)*100)
+		if seconds > 0 {
+			fmt.Printf(", %.2f MB/s", float64(before)/(1024*1024)/seconds)
+		}
+		fmt.Println()
+	}
+}
+
+// printFailureStreaks shows the current and longest runs of consecutive failed runs. Cancelled runs
+// neither extend nor end a streak.
+func printFailureStreaks(records []HistoryRecord) {
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Println("FAILURES")
+	fmt.Println(strings.Repeat("=", 50))
+	failed, longest, longestStart, longestEnd, streak, streakStart := 0, 0, 0, 0, 0, 0
+	var lastSuccess time.Time
+	for i, r := range records {
+		switch r.Status {
+		case "cancelled":
+		case "failed":
+			failed++
+			if streak == 0 {
+				streakStart = i
+			}
+			streak++
+			if streak > longest {
+				longest, longestStart, longestEnd = streak, streakStart, i
+			}
+		default:
+			streak = 0
+			lastSuccess = r.Time
+		}
+	}
+	fmt.Printf("Failed runs: %d of %d\n", failed, len(records))
+	if streak > 0 {
+		fmt.Printf("Current failure streak: %d run(s) since %s\n", streak,
+			records[streakStart].Time.Local().Format("2006-01-02 15:04"))
+	} else {
+		fmt.Println("Current failure streak: none")
+	}
+	if longest > 0 {
+		fmt.Printf("Longest failure streak: %d run(s), %s to %s\n", longest,
+			records[longestStart].Time.Local().Format("2006-01-02 15:04"),
+			records[longestEnd].Time.Local().Format("2006-01-02 15:04"))
+	}
+	if lastSuccess.IsZero() {
+		fmt.Println("Last successful run: never")
+	} else {
+		fmt.Printf("Last successful run: %s\n", lastSuccess.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+// printSiteVolumes shows the log volume per site and month with the change against the previous month.
+// When a period was archived by several runs, the most recent run provides its volume.
+func printSiteVolumes(records []HistoryRecord, onlySite string, months int) {
+	type key struct{ group, site string }
+	latest := make(map[key]HistoryVolume)
+	for _, r := range records {
+		for _, v := range r.Sites {
+			latest[key{v.Group, v.Site}] = v
+		}
+	}
+	// site -> month (yyyy-MM) -> bytes; daily groups are added up per month
+	volumes := make(map[string]map[string]int64)
+	for _, v := range latest {
+		if onlySite != "" && !strings.EqualFold(v.Site, onlySite) {
+			continue
+		}
+		month := v.Group
+		if len(month) > 7 {
+			month = month[:7]
+		}
+		if volumes[v.Site] == nil {
+			volumes[v.Site] = make(map[string]int64)
+		}
+		volumes[v.Site][month] += v.Bytes
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Println("LOG VOLUME PER SITE")
+	fmt.Println(strings.Repeat("=", 50))
+	if len(volumes) == 0 {
+		fmt.Println("No site volumes recorded")
+		return
+	}
+	sites := make([]string, 0, len(volumes))
+	for s := range volumes {
+		sites = append(sites, s)
+	}
+	sort.Strings(sites)
+	for _, s := range sites {
+		name := s
+		if name == "" {
+			name = "(source root)"
+		}
+		fmt.Println(name)
+		monthList := make([]string, 0, len(volumes[s]))
+		for m := range volumes[s] {
+			monthList = append(monthList, m)
+		}
+		sort.Strings(monthList)
+		start := 0
+		if months > 0 && len(monthList) > months {
+			start = len(monthList) - months
+		}
+		for i := start; i < len(monthList); i++ {
+			m := monthList[i]
+			b := volumes[s][m]
+			change := ""
+			if i > 0 {
+				if prev := volumes[s][monthList[i-1]]; prev > 0 {
+					pct := float64(b-prev) / float64(prev) * 100
+					change = fmt.Sprintf("%+.1f%%", pct)
+					if b >= 2*prev {
+						change += "  (doubled)"
+					}
+				}
+			}
+			fmt.Println(strings.TrimRight(fmt.Sprintf("  %s  %10.2f MB  %s", m, float64(b)/(1024*1024), change), " "))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hookOutputLimit is the number of trailing output bytes quoted in the error of a failed hook
+const hookOutputLimit = 2048
+
+// HookCommand is an external program run after each archive or at the end of a run
+type HookCommand struct {
+	Command        string   `json:"command"`         // program to run; empty disables the hook
+	Args           []string `json:"args"`            // arguments; {name} placeholders are replaced with the hook values
+	TimeoutSeconds int      `json:"timeout_seconds"` // default 300
+}
+
+// runHook runs a hook command. Every value is available as a {name} placeholder in the arguments and as an
+// IISLC_<NAME> environment variable. The output is passed through; a non-zero exit or timeout is an error.
+// Cancelling ctx kills the command and returns ctx.Err().
+func runHook(ctx context.Context, kind string, h HookCommand, values map[string]string, defaultArgs []string) error {
+	timeout := time.Duration(h.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	args := h.Args
+	if len(args) == 0 {
+		args = defaultArgs
+	}
+	pairs := make([]string, 0, 2*len(values))
+	env := os.Environ()
+	for k, v := range values {
+		pairs = append(pairs, "{"+k+"}", v)
+		env = append(env, "IISLC_"+strings.ToUpper(k)+"="+v)
+	}
+	r := strings.NewReplacer(pairs...)
+	expanded := make([]string, len(args))
+	for i, a := range args {
+		expanded[i] = r.Replace(a)
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, h.Command, expanded...)
+	cmd.Env = env
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// A grandchild that inherited stdout/stderr (e.g. a background process started by a .cmd script) keeps
+	// the pipes open after the hook exits; stop waiting for it shortly after the hook ends or is killed
+	cmd.WaitDelay = 5 * time.Second
+
+	logger.Info("running hook", "hook", kind, "command", h.Command, "args", strings.Join(expanded, " "))
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The hook itself exited successfully; only its output may be incomplete
+		logger.Warn("hook left a process holding its output open", "hook", kind)
+		err = nil
+	}
+	if out.Len() > 0 {
+		logger.Info("hook output", "hook", kind, "output", strings.TrimSpace(out.String()))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if hookCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %v", kind, timeout)
+	}
+	if err != nil {
+		tail := strings.TrimSpace(out.String())
+		if len(tail) > hookOutputLimit {
+			tail = "..." + tail[len(tail)-hookOutputLimit:]
+		}
+		if tail != "" {
+			return fmt.Errorf("%s failed: %v: %s", kind, err, tail)
+		}
+		return fmt.Errorf("%s failed: %v", kind, err)
+	}
+	return nil
+}
+
+// runPostArchiveHook runs post_archive_command for a finished archive; the status is "success" when every
+// file of the group was added and "partial" otherwise. A hook killed by a cancelled run is not an error.
+func runPostArchiveHook(ctx context.Context, archivePath, groupKey string, files []LogFile, manifest *Manifest) {
+	if config.PostArchiveCommand.Command == "" {
+		return
+	}
+	var sizeBefore int64
+	for _, e := range manifest.Entries {
+		sizeBefore += e.Size
+	}
+	var sizeAfter int64
+	if info, err := os.Stat(archivePath); err == nil {
+		sizeAfter = info.Size()
+	}
+	status := "success"
+	if len(manifest.Entries) < len(files) {
+		status = "partial"
+	}
+	values := map[string]string{
+		"archive":     archivePath,
+		"checksum":    archivePath + checksumExtension,
+		"manifest":    archivePath + manifestExtension,
+		"group":       groupKey,
+		"files":       strconv.Itoa(len(manifest.Entries)),
+		"size_before": strconv.FormatInt(sizeBefore, 10),
+		"size_after":  strconv.FormatInt(sizeAfter, 10),
+		"status":      status,
+	}
+	if err := runHook(ctx, "post_archive_command", config.PostArchiveCommand, values, []string{archivePath, groupKey}); ctx.Err() != nil {
+		logger.Warn("post_archive_command cancelled", "group", groupKey, "archive", archivePath)
+	} else if err != nil {
+		addError("hook_failed", groupKey, archivePath, fmt.Sprintf("%s: %v", archivePath, err))
+	}
+}
+
+// runPostRunHook runs post_run_command once at the end of a run, before the email is sent, so its failure
+// is included in the email and report
+func runPostRunHook(ctx context.Context) {
+	if config.PostRunCommand.Command == "" {
+		return
+	}
+	status := runStatus()
+	values := map[string]string{
+		"status":           status,
+		"groups":           strconv.Itoa(stats.GroupCount),
+		"files_processed":  strconv.Itoa(stats.FilesProcessed),
+		"files_compressed": strconv.Itoa(stats.FilesCompressed),
+		"size_before":      strconv.FormatInt(stats.TotalSizeBefore, 10),
+		"size_after":       strconv.FormatInt(stats.TotalSizeAfter, 10),
+		"errors":           strconv.Itoa(len(stats.Errors)),
+		"warnings":         strconv.Itoa(len(stats.Warnings)),
+		"duration_seconds": strconv.FormatFloat(stats.EndTime.Sub(stats.StartTime).Seconds(), 'f', 1, 64),
+		"dest_folder":      config.DestFolder,
+	}
+	if err := runHook(ctx, "post_run_command", config.PostRunCommand, values, []string{status}); err != nil {
+		addError("hook_failed", "", "", err.Error())
+	}
+}
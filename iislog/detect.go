@@ -0,0 +1,85 @@
+package iislog
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format identifies a log file format
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatW3C            // W3C extended log file format (IIS default)
+	FormatIIS            // Microsoft IIS log file format, comma separated with fixed fields
+	FormatNCSA           // NCSA common log file format
+)
+
+// detectBytes is how much of the start of a file is inspected to detect its format
+const detectBytes = 8192
+
+// detectLines is the number of non-empty lines inspected to detect a format
+const detectLines = 10
+
+// String returns the lower-case name of the format
+func (f Format) String() string {
+	switch f {
+	case FormatW3C:
+		return "w3c"
+	case FormatIIS:
+		return "iis"
+	case FormatNCSA:
+		return "ncsa"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectFormat inspects the first lines of a log file and reports its format
+func DetectFormat(head []byte) Format {
+	lines := bytes.Split(head, []byte("\n"))
+	if len(head) >= detectBytes && len(lines) > 1 {
+		// The last line may have been cut off
+		lines = lines[:len(lines)-1]
+	}
+	seen := 0
+	for _, raw := range lines {
+		line := strings.TrimRight(string(raw), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return FormatW3C
+		}
+		if ncsaLinePattern.MatchString(line) {
+			return FormatNCSA
+		}
+		if values, ok := splitIISLine(line); ok {
+			if _, ok := parseIISTime(values[2], values[3]); ok {
+				return FormatIIS
+			}
+		}
+		seen++
+		if seen >= detectLines {
+			break
+		}
+	}
+	return FormatUnknown
+}
+
+// DetectFile reads the start of a file and reports its format
+func DetectFile(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer f.Close()
+	head := make([]byte, detectBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return FormatUnknown, err
+	}
+	return DetectFormat(head[:n]), nil
+}
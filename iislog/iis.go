@@ -0,0 +1,54 @@
+package iislog
+
+import (
+	"strings"
+	"time"
+)
+
+// iisFields is the fixed layout of the Microsoft IIS log format, named after the W3C equivalents
+var iisFields = []string{
+	FieldClientIP, FieldUsername, FieldDate, FieldTime, FieldSiteName, FieldComputerName, FieldServerIP,
+	FieldTimeTaken, FieldBytesReceived, FieldBytesSent, FieldStatus, FieldWin32Status,
+	FieldMethod, FieldURIStem, FieldURIQuery,
+}
+
+// splitIISLine splits a comma separated IIS format line. The query string is the last field
+// and may itself contain commas, so everything after the 14th separator belongs to it.
+func splitIISLine(line string) ([]string, bool) {
+	parts := strings.SplitN(line, ",", len(iisFields))
+	if len(parts) != len(iisFields) {
+		return nil, false
+	}
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	last := len(parts) - 1
+	parts[last] = strings.TrimSpace(strings.TrimSuffix(parts[last], ","))
+	return parts, true
+}
+
+// parseIISTime parses the date and time columns, which IIS writes in the server's local time
+func parseIISTime(date, clock string) (time.Time, bool) {
+	for _, layout := range []string{"1/2/2006 15:04:05", "1/2/06 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, date+" "+clock, time.Local); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseIIS parses a Microsoft IIS log format line; timestamps are converted from local time to UTC
+func (r *Reader) parseIIS(line string) bool {
+	values, ok := splitIISLine(line)
+	if !ok {
+		return false
+	}
+	t, ok := parseIISTime(values[2], values[3])
+	if !ok {
+		return false
+	}
+	r.rec = Record{format: FormatIIS, fields: r.fields, index: r.index, values: values, line: line}
+	r.rec.fill()
+	r.rec.Time = t
+	return true
+}
@@ -0,0 +1,87 @@
+package iislog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ncsaLinePattern matches an NCSA common log format line:
+// host ident authuser [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326
+var ncsaLinePattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "([^"]*)" (\S+) (\S+)`)
+
+// ncsaFields is the layout of NCSA records, named after the W3C equivalents. The date and time
+// values are derived from the bracketed timestamp and normalised to UTC in W3C notation.
+var ncsaFields = []string{
+	FieldClientIP, FieldUsername, FieldDate, FieldTime, FieldMethod, FieldURIStem, FieldURIQuery,
+	FieldVersion, FieldStatus, FieldBytesSent,
+}
+
+// parseNCSA parses an NCSA common log format line
+func (r *Reader) parseNCSA(line string) bool {
+	m := ncsaLinePattern.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[4])
+	if err != nil {
+		return false
+	}
+	t = t.UTC()
+
+	method, stem, query, version := "-", "-", "-", "-"
+	if req := strings.Fields(m[5]); len(req) > 0 {
+		method = req[0]
+		if len(req) > 1 {
+			stem = req[1]
+			if s, q, found := strings.Cut(stem, "?"); found {
+				stem, query = s, q
+			}
+		}
+		if len(req) > 2 {
+			version = req[2]
+		}
+	}
+
+	values := []string{m[1], m[3], t.Format("2006-01-02"), t.Format("15:04:05"), method, stem, query, version, m[6], m[7]}
+	r.rec = Record{format: FormatNCSA, fields: r.fields, index: r.index, values: values, line: line}
+	r.rec.ncsa = &ncsaParts{ident: m[2], stamp: m[4], tail: line[len(m[0]):]}
+	r.rec.fill()
+	r.rec.Time = t
+	return true
+}
+
+// ncsaParts keeps the pieces of an NCSA line that have no W3C field, so it can be written back
+type ncsaParts struct {
+	ident string
+	stamp string
+	tail  string // e.g. the referer and user agent of the combined format
+}
+
+// ncsaString renders an NCSA record from its current values
+func (r *Record) ncsaString() string {
+	get := func(name string) string {
+		v, _ := r.Raw(name)
+		return v
+	}
+	var req []string
+	if m := get(FieldMethod); m != "-" {
+		req = append(req, m)
+	}
+	if stem := get(FieldURIStem); stem != "-" {
+		if q := get(FieldURIQuery); q != "-" {
+			stem += "?" + q
+		}
+		req = append(req, stem)
+	}
+	if v := get(FieldVersion); v != "-" {
+		req = append(req, v)
+	}
+	request := "-"
+	if len(req) > 0 {
+		request = strings.Join(req, " ")
+	}
+	return fmt.Sprintf("%s %s %s [%s] \"%s\" %s %s%s", get(FieldClientIP), r.ncsa.ident, get(FieldUsername),
+		r.ncsa.stamp, request, get(FieldStatus), get(FieldBytesSent), r.ncsa.tail)
+}
@@ -0,0 +1,131 @@
+package iislog
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Reader iterates over the records of a log file in one of the supported formats
+type Reader struct {
+	sc        *bufio.Scanner
+	format    Format
+	header    Header
+	fields    []string
+	index     map[string]int
+	rec       Record
+	lineNo    int
+	malformed int
+	err       error
+
+	// OnDirective, when set, is called with every W3C directive line (those starting with "#")
+	OnDirective func(line string)
+	// OnMalformed, when set, is called with every data line that could not be parsed
+	OnMalformed func(line string)
+}
+
+// NewReader detects the format from the first lines of r and returns a reader for it.
+// Input in an unrecognised format is read as W3C.
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReaderSize(r, detectBytes)
+	head, _ := br.Peek(detectBytes)
+	format := DetectFormat(head)
+	if format == FormatUnknown {
+		format = FormatW3C
+	}
+	return newReader(br, format)
+}
+
+// NewW3CReader returns a reader for W3C extended log data
+func NewW3CReader(r io.Reader) *Reader {
+	return newReader(r, FormatW3C)
+}
+
+// NewIISReader returns a reader for Microsoft IIS log format data
+func NewIISReader(r io.Reader) *Reader {
+	return newReader(r, FormatIIS)
+}
+
+// NewNCSAReader returns a reader for NCSA common log format data
+func NewNCSAReader(r io.Reader) *Reader {
+	return newReader(r, FormatNCSA)
+}
+
+func newReader(r io.Reader, format Format) *Reader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	lr := &Reader{sc: sc, format: format}
+	switch format {
+	case FormatIIS:
+		lr.fields, lr.index = iisFields, fieldIndex(iisFields)
+	case FormatNCSA:
+		lr.fields, lr.index = ncsaFields, fieldIndex(ncsaFields)
+	}
+	return lr
+}
+
+// Next advances to the next record, returning false at the end of the input or on error
+func (r *Reader) Next() bool {
+	for r.sc.Scan() {
+		r.lineNo++
+		line := strings.TrimRight(r.sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		var ok bool
+		switch r.format {
+		case FormatIIS:
+			ok = r.parseIIS(line)
+		case FormatNCSA:
+			ok = r.parseNCSA(line)
+		default:
+			if line[0] == '#' {
+				r.directive(line)
+				if r.OnDirective != nil {
+					r.OnDirective(line)
+				}
+				continue
+			}
+			ok = r.fields != nil && r.parseW3C(line)
+		}
+		if ok {
+			return true
+		}
+		r.malformed++
+		if r.OnMalformed != nil {
+			r.OnMalformed(line)
+		}
+	}
+	r.err = r.sc.Err()
+	return false
+}
+
+// Format returns the format the reader parses
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Record returns the current record; it is overwritten by the next call to Next
+func (r *Reader) Record() *Record {
+	return &r.rec
+}
+
+// Header returns the W3C directives in effect for the current record
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Line returns the 1-based line number of the current record
+func (r *Reader) Line() int {
+	return r.lineNo
+}
+
+// Malformed returns the number of data lines skipped so far because they could not be parsed
+func (r *Reader) Malformed() int {
+	return r.malformed
+}
+
+// Err returns the first read error encountered
+func (r *Reader) Err() error {
+	return r.err
+}
@@ -0,0 +1,347 @@
+package iislog
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAll returns a copy of every record read by r and the number of malformed lines
+func readAll(t *testing.T, r *Reader) ([]Record, int) {
+	t.Helper()
+	var recs []Record
+	for r.Next() {
+		rec := *r.Record()
+		recs = append(recs, rec)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	return recs, r.Malformed()
+}
+
+func TestW3CReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []map[string]string // field values per record, read with Get
+		wantTimes []string
+		malformed int
+	}{
+		{
+			name: "basic",
+			input: "#Software: Microsoft Internet Information Services 10.0\r\n" +
+				"#Fields: date time cs-method cs-uri-stem sc-status\r\n" +
+				"2024-05-03 10:00:00 GET /index.html 200\r\n",
+			want:      []map[string]string{{"cs-method": "GET", "cs-uri-stem": "/index.html", "sc-status": "200"}},
+			wantTimes: []string{"2024-05-03T10:00:00Z"},
+		},
+		{
+			name: "fields change mid-file",
+			input: "#Fields: date time c-ip sc-status\n" +
+				"2024-05-03 10:00:00 10.0.0.1 200\n" +
+				"#Fields: date time cs-method c-ip sc-status time-taken\n" +
+				"2024-05-03 11:00:00 POST 10.0.0.2 500 15\n",
+			want: []map[string]string{
+				{"c-ip": "10.0.0.1", "sc-status": "200", "cs-method": ""},
+				{"c-ip": "10.0.0.2", "sc-status": "500", "cs-method": "POST", "time-taken": "15"},
+			},
+			wantTimes: []string{"2024-05-03T10:00:00Z", "2024-05-03T11:00:00Z"},
+		},
+		{
+			name: "plus encoded user agent and null values",
+			input: "#Fields: date time cs(User-Agent) cs-uri-query cs-username\n" +
+				"2024-05-03 10:00:00 Mozilla/5.0+(Windows+NT+10.0) - -\n",
+			want:      []map[string]string{{"cs(user-agent)": "Mozilla/5.0 (Windows NT 10.0)", "cs-uri-query": "", "cs-username": ""}},
+			wantTimes: []string{"2024-05-03T10:00:00Z"},
+		},
+		{
+			name: "time without date uses the #Date directive",
+			input: "#Date: 2024-05-03 00:00:00\n" +
+				"#Fields: time sc-status\n" +
+				"08:30:00 404\n",
+			want:      []map[string]string{{"sc-status": "404"}},
+			wantTimes: []string{"2024-05-03T08:30:00Z"},
+		},
+		{
+			name: "malformed lines are counted and skipped",
+			input: "2024-05-03 09:00:00 before any fields directive\n" +
+				"#Fields: date time sc-status\n" +
+				"2024-05-03 10:00:00 200 extra\n" +
+				"2024-05-03 10:00:01\n" +
+				"\n" +
+				"2024-05-03 10:00:02 304\n",
+			want:      []map[string]string{{"sc-status": "304"}},
+			wantTimes: []string{"2024-05-03T10:00:02Z"},
+			malformed: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, malformed := readAll(t, NewW3CReader(strings.NewReader(tt.input)))
+			checkRecords(t, recs, tt.want, tt.wantTimes)
+			if malformed != tt.malformed {
+				t.Errorf("Malformed() = %d, want %d", malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestW3CTypedFields(t *testing.T) {
+	input := "#Fields: date time s-port c-ip sc-status sc-substatus sc-win32-status sc-bytes cs-bytes time-taken\n" +
+		"2024-05-03 10:00:00 443 10.0.0.1 503 2 64 1234 567 89\n"
+	r := NewW3CReader(strings.NewReader(input))
+	if !r.Next() {
+		t.Fatalf("Next() = false, err %v", r.Err())
+	}
+	rec := r.Record()
+	if rec.ServerPort != 443 || rec.ClientIP != "10.0.0.1" || rec.Status != 503 || rec.SubStatus != 2 ||
+		rec.Win32Status != 64 || rec.BytesSent != 1234 || rec.BytesReceived != 567 ||
+		rec.TimeTaken != 89*time.Millisecond {
+		t.Errorf("typed fields = %+v", rec)
+	}
+	if !rec.Has("SC-STATUS") || rec.Has("cs-host") {
+		t.Errorf("Has: field lookup should be case-insensitive and limited to #Fields")
+	}
+}
+
+func TestIISReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []map[string]string
+		malformed int
+	}{
+		{
+			name:  "basic",
+			input: "10.0.0.1, -, 5/3/2024, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /index.html, -,\r\n",
+			want: []map[string]string{{"c-ip": "10.0.0.1", "cs-username": "", "s-sitename": "W3SVC1",
+				"s-computername": "WEB01", "sc-status": "200", "cs-method": "GET", "cs-uri-stem": "/index.html", "cs-uri-query": ""}},
+		},
+		{
+			name:  "query string with commas",
+			input: "10.0.0.1, alice, 5/3/24, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /search, q=a,b,c,\n",
+			want:  []map[string]string{{"cs-username": "alice", "cs-uri-query": "q=a,b,c"}},
+		},
+		{
+			name: "malformed lines",
+			input: "10.0.0.1, -, 5/3/2024, 10:00:00, W3SVC1\n" +
+				"10.0.0.1, -, 2024-05-03, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /a, -,\n" +
+				"10.0.0.2, -, 5/3/2024, 10:00:01, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 404, 2, GET, /b, -,\n",
+			want:      []map[string]string{{"c-ip": "10.0.0.2", "sc-status": "404", "sc-win32-status": "2"}},
+			malformed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, malformed := readAll(t, NewIISReader(strings.NewReader(tt.input)))
+			checkRecords(t, recs, tt.want, nil)
+			if malformed != tt.malformed {
+				t.Errorf("Malformed() = %d, want %d", malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestIISTimeIsLocal(t *testing.T) {
+	saved := time.Local
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+	defer func() { time.Local = saved }()
+
+	input := "10.0.0.1, -, 5/3/2024, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /, -,\n"
+	r := NewIISReader(strings.NewReader(input))
+	if !r.Next() {
+		t.Fatalf("Next() = false, err %v", r.Err())
+	}
+	if got, want := r.Record().Time, time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Time = %v, want %v", got, want)
+	}
+}
+
+func TestNCSAReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []map[string]string
+		wantTimes []string
+		malformed int
+	}{
+		{
+			name:  "common format",
+			input: `10.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?x=1 HTTP/1.0" 200 2326` + "\n",
+			want: []map[string]string{{"c-ip": "10.0.0.1", "cs-username": "frank", "cs-method": "GET",
+				"cs-uri-stem": "/apache_pb.gif", "cs-uri-query": "x=1", "cs-version": "HTTP/1.0", "sc-status": "200", "sc-bytes": "2326"}},
+			wantTimes: []string{"2000-10-10T20:55:36Z"},
+		},
+		{
+			name: "combined format with quoted referer and user agent",
+			input: `10.0.0.1 - - [03/May/2024:10:00:00 +0000] "POST /login HTTP/1.1" 302 - ` +
+				`"https://example.com/a b" "Mozilla/5.0 (X11; Linux)"` + "\n",
+			want:      []map[string]string{{"cs-method": "POST", "cs-uri-stem": "/login", "cs-uri-query": "", "sc-bytes": ""}},
+			wantTimes: []string{"2024-05-03T10:00:00Z"},
+		},
+		{
+			name:      "empty request",
+			input:     `10.0.0.1 - - [03/May/2024:10:00:00 +0000] "" 400 0` + "\n",
+			want:      []map[string]string{{"cs-method": "", "cs-uri-stem": "", "sc-status": "400"}},
+			wantTimes: []string{"2024-05-03T10:00:00Z"},
+		},
+		{
+			name: "malformed lines",
+			input: `10.0.0.1 - - [03/May/2024 10:00:00] "GET / HTTP/1.1" 200 1` + "\n" +
+				`10.0.0.1 - - [03/May/2024:10:00:00 +0000] GET / HTTP/1.1 200 1` + "\n" +
+				`10.0.0.2 - - [03/May/2024:10:00:01 +0000] "GET / HTTP/1.1" 200 1` + "\n",
+			want:      []map[string]string{{"c-ip": "10.0.0.2"}},
+			wantTimes: []string{"2024-05-03T10:00:01Z"},
+			malformed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, malformed := readAll(t, NewNCSAReader(strings.NewReader(tt.input)))
+			checkRecords(t, recs, tt.want, tt.wantTimes)
+			if malformed != tt.malformed {
+				t.Errorf("Malformed() = %d, want %d", malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestRecordSetString(t *testing.T) {
+	tests := []struct {
+		name  string
+		r     *Reader
+		field string
+		value string
+		want  string
+	}{
+		{
+			name:  "w3c encodes spaces",
+			r:     NewW3CReader(strings.NewReader("#Fields: date time c-ip cs-username\n2024-05-03 10:00:00 10.0.0.1 bob\n")),
+			field: "cs-username",
+			value: "john doe",
+			want:  "2024-05-03 10:00:00 10.0.0.1 john+doe",
+		},
+		{
+			name:  "iis null value",
+			r:     NewIISReader(strings.NewReader("10.0.0.1, bob, 5/3/2024, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /, -,\n")),
+			field: "cs-username",
+			value: "",
+			want:  "10.0.0.1, -, 5/3/2024, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /, -,",
+		},
+		{
+			name:  "ncsa keeps the combined tail",
+			r:     NewNCSAReader(strings.NewReader(`10.0.0.1 - - [03/May/2024:10:00:00 +0000] "GET / HTTP/1.1" 200 5 "-" "curl/8"` + "\n")),
+			field: "c-ip",
+			value: "0.0.0.0",
+			want:  `0.0.0.0 - - [03/May/2024:10:00:00 +0000] "GET / HTTP/1.1" 200 5 "-" "curl/8"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.r.Next() {
+				t.Fatalf("Next() = false, err %v", tt.r.Err())
+			}
+			rec := tt.r.Record()
+			if !rec.Set(tt.field, tt.value) {
+				t.Fatalf("Set(%q) = false", tt.field)
+			}
+			if got := rec.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if rec.Set("no-such-field", "x") {
+				t.Errorf("Set of an absent field = true")
+			}
+		})
+	}
+}
+
+func TestLineCap(t *testing.T) {
+	const limit = 1024 * 1024
+	header := "#Fields: date time cs-uri-query\n"
+	fits := "2024-05-03 10:00:00 " + strings.Repeat("a", limit-100) + "\n"
+	tooLong := "2024-05-03 10:00:01 " + strings.Repeat("b", limit) + "\n"
+
+	r := NewW3CReader(strings.NewReader(header + fits + tooLong + "2024-05-03 10:00:02 c\n"))
+	if !r.Next() {
+		t.Fatalf("line below the cap: Next() = false, err %v", r.Err())
+	}
+	if got := len(r.Record().URIQuery); got != limit-100 {
+		t.Errorf("len(URIQuery) = %d, want %d", got, limit-100)
+	}
+	if r.Next() {
+		t.Fatalf("line above the cap: Next() = true")
+	}
+	if !errors.Is(r.Err(), bufio.ErrTooLong) {
+		t.Errorf("Err() = %v, want %v", r.Err(), bufio.ErrTooLong)
+	}
+}
+
+func TestNewReaderDetects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Format
+	}{
+		{"w3c", "#Software: IIS\n#Fields: date time sc-status\n2024-05-03 10:00:00 200\n", FormatW3C},
+		{"iis", "10.0.0.1, -, 5/3/2024, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /, -,\n", FormatIIS},
+		{"ncsa", `10.0.0.1 - - [03/May/2024:10:00:00 +0000] "GET / HTTP/1.1" 200 5` + "\n", FormatNCSA},
+		{"unknown reads as w3c", "just some text\n", FormatW3C},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			if r.Format() != tt.want {
+				t.Fatalf("Format() = %v, want %v", r.Format(), tt.want)
+			}
+			if tt.want != FormatW3C || strings.HasPrefix(tt.input, "#") {
+				if !r.Next() {
+					t.Errorf("Next() = false, err %v", r.Err())
+				}
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want Format
+	}{
+		{"empty", "", FormatUnknown},
+		{"blank lines then directive", "\r\n\r\n#Version: 1.0\r\n", FormatW3C},
+		{"iis two digit year", "10.0.0.1, -, 5/3/24, 10:00:00, W3SVC1, WEB01, 10.0.0.10, 15, 300, 1200, 200, 0, GET, /, -,\n", FormatIIS},
+		{"comma separated but no IIS date", "a, b, c, d, e, f, g, h, i, j, k, l, m, n, o,\n", FormatUnknown},
+		{"ncsa after garbage", "garbage\n" + `10.0.0.1 - - [03/May/2024:10:00:00 +0000] "GET / HTTP/1.1" 200 5` + "\n", FormatNCSA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat([]byte(tt.head)); got != tt.want {
+				t.Errorf("DetectFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkRecords compares the Get values and, when given, the RFC 3339 times of the records
+func checkRecords(t *testing.T, recs []Record, want []map[string]string, times []string) {
+	t.Helper()
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(recs), len(want))
+	}
+	for i := range recs {
+		for field, v := range want[i] {
+			if got := recs[i].Get(field); got != v {
+				t.Errorf("record %d: Get(%q) = %q, want %q", i, field, got, v)
+			}
+		}
+		if times != nil {
+			if got := recs[i].Time.Format(time.RFC3339); got != times[i] {
+				t.Errorf("record %d: Time = %s, want %s", i, got, times[i])
+			}
+		}
+	}
+}
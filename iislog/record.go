@@ -0,0 +1,231 @@
+// Package iislog parses web server log files (W3C extended, Microsoft IIS and NCSA common
+// formats) into typed records that share one model.
+package iislog
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Standard W3C extended field names written by IIS. Records of the other formats expose
+// their values under the same names.
+const (
+	FieldDate          = "date"
+	FieldTime          = "time"
+	FieldSiteName      = "s-sitename"
+	FieldComputerName  = "s-computername"
+	FieldServerIP      = "s-ip"
+	FieldMethod        = "cs-method"
+	FieldURIStem       = "cs-uri-stem"
+	FieldURIQuery      = "cs-uri-query"
+	FieldServerPort    = "s-port"
+	FieldUsername      = "cs-username"
+	FieldClientIP      = "c-ip"
+	FieldVersion       = "cs-version"
+	FieldUserAgent     = "cs(user-agent)"
+	FieldCookie        = "cs(cookie)"
+	FieldReferer       = "cs(referer)"
+	FieldHost          = "cs-host"
+	FieldStatus        = "sc-status"
+	FieldSubStatus     = "sc-substatus"
+	FieldWin32Status   = "sc-win32-status"
+	FieldBytesSent     = "sc-bytes"
+	FieldBytesReceived = "cs-bytes"
+	FieldTimeTaken     = "time-taken"
+)
+
+// Record is a single parsed log line. Typed fields hold the zero value when the field is
+// absent or null ("-"); use Has and Get to tell those cases apart.
+type Record struct {
+	Time          time.Time // date and time of the request in UTC
+	SiteName      string
+	ComputerName  string
+	ServerIP      string
+	Method        string
+	URIStem       string
+	URIQuery      string
+	ServerPort    int
+	Username      string
+	ClientIP      string
+	Version       string
+	UserAgent     string
+	Cookie        string
+	Referer       string
+	Host          string
+	Status        int
+	SubStatus     int
+	Win32Status   int64
+	BytesSent     int64
+	BytesReceived int64
+	TimeTaken     time.Duration
+
+	format Format
+	fields []string // lower-case field names, shared by all records of a layout
+	index  map[string]int
+	values []string // raw values as written in the file
+	line   string
+	ncsa   *ncsaParts
+}
+
+// Format returns the log format the record was read from
+func (r *Record) Format() Format {
+	return r.format
+}
+
+// Fields returns the lower-case field names in effect for this record
+func (r *Record) Fields() []string {
+	return r.fields
+}
+
+// Has reports whether the field is present in the record's field list
+func (r *Record) Has(name string) bool {
+	_, ok := r.index[strings.ToLower(name)]
+	return ok
+}
+
+// Raw returns the value exactly as written in the file ("-" for null)
+func (r *Record) Raw(name string) (string, bool) {
+	i, ok := r.index[strings.ToLower(name)]
+	if !ok || i >= len(r.values) {
+		return "", false
+	}
+	return r.values[i], true
+}
+
+// Get returns the decoded value of a field, or "" when it is absent or null
+func (r *Record) Get(name string) string {
+	v, ok := r.Raw(name)
+	if !ok {
+		return ""
+	}
+	return r.decode(v)
+}
+
+// Line returns the original text of the record
+func (r *Record) Line() string {
+	return r.line
+}
+
+// Set replaces the value of a field that is present in the record, encoding it the way the
+// record's format writes values ("" becomes "-"). It reports whether the field exists.
+// Use String to render the modified record.
+func (r *Record) Set(name, value string) bool {
+	i, ok := r.index[strings.ToLower(name)]
+	if !ok || i >= len(r.values) {
+		return false
+	}
+	r.values[i] = r.encode(value, i == len(r.values)-1)
+	t := r.Time
+	*r = Record{format: r.format, fields: r.fields, index: r.index, values: r.values, line: r.line, ncsa: r.ncsa}
+	r.fill()
+	r.Time = t
+	return true
+}
+
+// String renders the record in its original format from its current values
+func (r *Record) String() string {
+	switch r.format {
+	case FormatIIS:
+		return strings.Join(r.values, ", ") + ","
+	case FormatNCSA:
+		return r.ncsaString()
+	default:
+		return strings.Join(r.values, " ")
+	}
+}
+
+// encode is the inverse of decode for the record's format. Only the last column of the IIS
+// format may contain commas.
+func (r *Record) encode(v string, last bool) string {
+	if v == "" {
+		return "-"
+	}
+	switch r.format {
+	case FormatW3C:
+		return strings.ReplaceAll(v, " ", "+")
+	case FormatIIS:
+		if last {
+			return v
+		}
+		return strings.ReplaceAll(v, ",", "%2C")
+	default:
+		return strings.ReplaceAll(v, " ", "%20")
+	}
+}
+
+// decode turns "-" into "" and, for W3C logs, "+" into spaces as IIS encodes them
+func (r *Record) decode(v string) string {
+	if v == "-" {
+		return ""
+	}
+	if r.format == FormatW3C {
+		return strings.ReplaceAll(v, "+", " ")
+	}
+	return v
+}
+
+// fill populates the typed fields from the raw values; Time is set by the format parser
+func (r *Record) fill() {
+	for i, name := range r.fields {
+		if i >= len(r.values) {
+			break
+		}
+		raw := r.values[i]
+		if raw == "-" {
+			continue
+		}
+		switch name {
+		case FieldSiteName:
+			r.SiteName = raw
+		case FieldComputerName:
+			r.ComputerName = raw
+		case FieldServerIP:
+			r.ServerIP = raw
+		case FieldMethod:
+			r.Method = raw
+		case FieldURIStem:
+			r.URIStem = r.decode(raw)
+		case FieldURIQuery:
+			r.URIQuery = r.decode(raw)
+		case FieldServerPort:
+			r.ServerPort, _ = strconv.Atoi(raw)
+		case FieldUsername:
+			r.Username = r.decode(raw)
+		case FieldClientIP:
+			r.ClientIP = raw
+		case FieldVersion:
+			r.Version = raw
+		case FieldUserAgent:
+			r.UserAgent = r.decode(raw)
+		case FieldCookie:
+			r.Cookie = r.decode(raw)
+		case FieldReferer:
+			r.Referer = r.decode(raw)
+		case FieldHost:
+			r.Host = r.decode(raw)
+		case FieldStatus:
+			r.Status, _ = strconv.Atoi(raw)
+		case FieldSubStatus:
+			r.SubStatus, _ = strconv.Atoi(raw)
+		case FieldWin32Status:
+			r.Win32Status, _ = strconv.ParseInt(raw, 10, 64)
+		case FieldBytesSent:
+			r.BytesSent, _ = strconv.ParseInt(raw, 10, 64)
+		case FieldBytesReceived:
+			r.BytesReceived, _ = strconv.ParseInt(raw, 10, 64)
+		case FieldTimeTaken:
+			ms, _ := strconv.ParseInt(raw, 10, 64)
+			r.TimeTaken = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// fieldIndex builds the name to position lookup for a layout
+func fieldIndex(fields []string) map[string]int {
+	index := make(map[string]int, len(fields))
+	for i, f := range fields {
+		index[f] = i
+	}
+	return index
+}
@@ -0,0 +1,62 @@
+package iislog
+
+import (
+	"strings"
+	"time"
+)
+
+// Header holds the W3C directives in effect at the current position of a file
+type Header struct {
+	Software string
+	Version  string
+	Date     time.Time
+	Remark   string
+	Fields   []string
+}
+
+// directive applies a W3C directive line; #Fields may change the layout anywhere in a file
+func (r *Reader) directive(line string) {
+	name, value, _ := strings.Cut(line[1:], ":")
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "software":
+		r.header.Software = value
+	case "version":
+		r.header.Version = value
+	case "date":
+		if t, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+			r.header.Date = t
+		}
+	case "remark":
+		r.header.Remark = value
+	case "fields":
+		names := strings.Fields(value)
+		r.header.Fields = names
+		r.fields = make([]string, len(names))
+		for i, n := range names {
+			r.fields[i] = strings.ToLower(n)
+		}
+		r.index = fieldIndex(r.fields)
+	}
+}
+
+// parseW3C parses a space separated data line using the current #Fields layout
+func (r *Reader) parseW3C(line string) bool {
+	values := strings.Fields(line)
+	if len(values) != len(r.fields) {
+		return false
+	}
+	r.rec = Record{format: FormatW3C, fields: r.fields, index: r.index, values: values, line: line}
+	r.rec.fill()
+
+	date, clock := r.rec.Get(FieldDate), r.rec.Get(FieldTime)
+	if clock != "" {
+		if date == "" && !r.header.Date.IsZero() {
+			date = r.header.Date.Format("2006-01-02")
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", date+" "+clock); err == nil {
+			r.rec.Time = t
+		}
+	}
+	return true
+}
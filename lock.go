@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockFileName is created in dest_folder for the duration of a run so that two instances never archive
+// the same groups
+const lockFileName = ".iis-log-compressor.lock"
+
+// lockInfo is the content of the lock file
+type lockInfo struct {
+	PID          int       `json:"pid"`
+	ProcessStart string    `json:"process_start,omitempty"` // processStartID of the holder, "" if unknown
+	Host         string    `json:"host"`
+	StartTime    time.Time `json:"start_time"`
+	Command      string    `json:"command"`
+}
+
+// lockHeldError is returned when a live instance holds the lock
+type lockHeldError struct {
+	Path string
+	Info lockInfo
+}
+
+func (e *lockHeldError) Error() string {
+	return fmt.Sprintf("another run is in progress on %s (PID %d, started %s); lock file %s",
+		e.Info.Host, e.Info.PID, e.Info.StartTime.Local().Format("2006-01-02 15:04:05"), e.Path)
+}
+
+// runLock is a lock file held by this process
+type runLock struct {
+	path string
+	info lockInfo
+}
+
+// acquireRunLock creates the lock file in dest_folder. A lock left by a process that no longer runs on this
+// host, or older than lock_stale_hours, is treated as stale and replaced.
+func acquireRunLock(command string) (*runLock, error) {
+	if err := os.MkdirAll(config.DestFolder, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination folder: %v", err)
+	}
+	host, _ := os.Hostname()
+	l := &runLock{
+		path: filepath.Join(config.DestFolder, lockFileName),
+		info: lockInfo{PID: os.Getpid(), ProcessStart: processStartID(os.Getpid()), Host: host, StartTime: time.Now(), Command: command},
+	}
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, werr := f.Write(data)
+			if cerr := f.Close(); werr == nil {
+				werr = cerr
+			}
+			if werr != nil {
+				_ = os.Remove(l.path)
+				return nil, fmt.Errorf("write lock file %s: %v", l.path, werr)
+			}
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("create lock file %s: %v", l.path, err)
+		}
+		held, content, reason := readLock(l.path)
+		if reason == "" {
+			return nil, &lockHeldError{Path: l.path, Info: held}
+		}
+		logger.Warn("removing stale lock file", "path", l.path, "reason", reason, "pid", held.PID, "host", held.Host,
+			"started", held.StartTime.Format(time.RFC3339))
+		if err := removeStaleLock(l.path, content); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not acquire lock file %s", l.path)
+}
+
+// readLock returns the holder of an existing lock, the content of the lock file and why it is stale, or ""
+// if it is held
+func readLock(path string) (lockInfo, []byte, string) {
+	var info lockInfo
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return info, nil, "lock file disappeared"
+	}
+	if err != nil {
+		// Unreadable but present: assume it is held rather than risk two runs
+		return info, nil, ""
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		// A crash between create and write leaves an empty file; only its age tells it apart from a lock
+		// that is being written right now
+		if st, serr := os.Stat(path); serr == nil && time.Since(st.ModTime()) > time.Minute {
+			return info, data, "unreadable lock file"
+		}
+		return info, data, ""
+	}
+	host, _ := os.Hostname()
+	if info.Host == host {
+		// The process table is authoritative on this host: a live holder keeps the lock however long it runs,
+		// unless its PID now belongs to a process started after a crash or reboot
+		if !processAlive(info.PID) {
+			return info, data, "process no longer running"
+		}
+		if info.ProcessStart != "" {
+			if current := processStartID(info.PID); current != "" {
+				if current != info.ProcessStart {
+					return info, data, "PID reused by another process"
+				}
+				return info, data, ""
+			}
+		}
+		// Without the process start time a reused PID cannot be told apart, so the age limit applies as well
+	}
+	// The holder on another host (shared dest_folder) cannot be checked, so only its age tells a crash apart
+	if config.LockStaleHours > 0 && time.Since(info.StartTime) > time.Duration(config.LockStaleHours)*time.Hour {
+		return info, data, fmt.Sprintf("older than lock_stale_hours (%d)", config.LockStaleHours)
+	}
+	return info, data, ""
+}
+
+// removeStaleLock removes the lock file if it still has the stale content. Another instance may have
+// replaced the stale lock with its own in the meantime, so the file is first moved to a name unique to this
+// process, which only one instance can do, and put back if it turns out to be a different lock.
+func removeStaleLock(path string, stale []byte) error {
+	moved := fmt.Sprintf("%s.stale-%d", path, os.Getpid())
+	if err := os.Rename(path, moved); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("remove stale lock file %s: %v", path, err)
+	}
+	data, err := os.ReadFile(moved)
+	if err != nil || !bytes.Equal(data, stale) {
+		// A new lock: restore it unless yet another instance created one, which then holds the lock
+		if err := os.Link(moved, path); err != nil && !os.IsExist(err) {
+			logger.Warn("failed to restore lock file", "path", path, "error", err)
+		}
+	}
+	if err := os.Remove(moved); err != nil {
+		return fmt.Errorf("remove stale lock file %s: %v", moved, err)
+	}
+	return nil
+}
+
+// Release removes the lock file if it is still ours
+func (l *runLock) Release() {
+	if l == nil {
+		return
+	}
+	var info lockInfo
+	data, err := os.ReadFile(l.path)
+	if err != nil || json.Unmarshal(data, &info) != nil || info.PID != l.info.PID || info.Host != l.info.Host ||
+		!info.StartTime.Equal(l.info.StartTime) {
+		logger.Warn("lock file was replaced by another instance, leaving it", "path", l.path)
+		return
+	}
+	if err := os.Remove(l.path); err != nil {
+		logger.Warn("failed to remove lock file", "path", l.path, "error", err)
+	}
+}
+
+// isLockHeld reports whether err means another instance holds the lock
+func isLockHeld(err error) bool {
+	var held *lockHeldError
+	return errors.As(err, &held)
+}
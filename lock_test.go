@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestLock writes a lock file with the given holder into dir
+func writeTestLock(t *testing.T, dir string, info lockInfo) string {
+	t.Helper()
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadLock(t *testing.T) {
+	host, _ := os.Hostname()
+	self := os.Getpid()
+	selfStart := processStartID(self)
+	old := time.Now().Add(-48 * time.Hour)
+	tests := []struct {
+		name      string
+		info      lockInfo
+		wantStale bool
+	}{
+		{"live process on this host", lockInfo{PID: self, ProcessStart: selfStart, Host: host, StartTime: time.Now()}, false},
+		// Where the start time cannot be read, lock_stale_hours applies on this host as well
+		{"live process on this host, old lock", lockInfo{PID: self, ProcessStart: selfStart, Host: host, StartTime: old}, selfStart == ""},
+		{"dead process on this host", lockInfo{PID: 1 << 30, Host: host, StartTime: time.Now()}, true},
+		{"other host, recent lock", lockInfo{PID: self, Host: "other-host", StartTime: time.Now()}, false},
+		{"other host, old lock", lockInfo{PID: self, Host: "other-host", StartTime: old}, true},
+		// Where the start time cannot be read, a recent lock is held
+		{"PID reused on this host", lockInfo{PID: self, ProcessStart: "earlier-process", Host: host, StartTime: time.Now()}, selfStart != ""},
+	}
+	saved := config.LockStaleHours
+	defer func() { config.LockStaleHours = saved }()
+	config.LockStaleHours = 24
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestLock(t, t.TempDir(), tt.info)
+			info, _, reason := readLock(path)
+			if (reason != "") != tt.wantStale {
+				t.Errorf("stale reason %q, want stale %v", reason, tt.wantStale)
+			}
+			if info.PID != tt.info.PID || info.Host != tt.info.Host {
+				t.Errorf("holder = %+v, want %+v", info, tt.info)
+			}
+		})
+	}
+}
+
+func TestAcquireRunLock(t *testing.T) {
+	host, _ := os.Hostname()
+	saved := config.DestFolder
+	defer func() { config.DestFolder = saved }()
+	config.DestFolder = t.TempDir()
+
+	// A lock of a dead process is replaced
+	path := writeTestLock(t, config.DestFolder, lockInfo{PID: 1 << 30, Host: host, StartTime: time.Now()})
+	l, err := acquireRunLock("test")
+	if err != nil {
+		t.Fatalf("stale lock not replaced: %v", err)
+	}
+	if info, _, reason := readLock(path); reason != "" || info.PID != os.Getpid() {
+		t.Errorf("lock holder = %+v (%s), want this process", info, reason)
+	}
+	if matches, _ := filepath.Glob(path + ".stale-*"); len(matches) != 0 {
+		t.Errorf("moved stale lock left behind: %v", matches)
+	}
+
+	// The live lock keeps out a second run
+	if _, err := acquireRunLock("test"); !isLockHeld(err) {
+		t.Errorf("second acquire: error = %v, want the lock to be held", err)
+	}
+
+	l.Release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed on release: %v", err)
+	}
+}
+
+func TestRemoveStaleLockKeepsNewLock(t *testing.T) {
+	dir := t.TempDir()
+	host, _ := os.Hostname()
+	// Another instance replaced the stale lock after it was read
+	path := writeTestLock(t, dir, lockInfo{PID: os.Getpid(), Host: host, StartTime: time.Now()})
+	if err := removeStaleLock(path, []byte(`{"pid":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, reason := readLock(path); reason != "" {
+		t.Errorf("the new lock was removed: %s", reason)
+	}
+	if matches, _ := filepath.Glob(path + ".stale-*"); len(matches) != 0 {
+		t.Errorf("moved lock left behind: %v", matches)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LoggingConfig controls the structured log written to the console and to the tool's own log file
+type LoggingConfig struct {
+	Level      string `json:"level"`       // "debug", "info" (default), "warn" or "error"
+	Format     string `json:"format"`      // "text" (default) or "json"
+	File       string `json:"file"`        // log file; empty logs to the console only
+	MaxSizeMB  int    `json:"max_size_mb"` // rotate the file at this size, default 10
+	MaxBackups int    `json:"max_backups"` // rotated files kept as file.1 ... file.N, default 5
+	Console    *bool  `json:"console"`     // also log to stdout, default true
+}
+
+// logger is the structured logger of the run. Events about a file carry the same fields everywhere:
+// group (month or day), archive (archive path) and source (original log file path).
+var logger = slog.New(newConsoleHandler(os.Stdout, "text", slog.LevelInfo))
+
+// validateLoggingConfig applies the logging defaults
+func validateLoggingConfig(l *LoggingConfig) error {
+	l.Level = strings.ToLower(strings.TrimSpace(l.Level))
+	if l.Level == "" {
+		l.Level = "info"
+	}
+	if _, err := parseLogLevel(l.Level); err != nil {
+		return err
+	}
+	l.Format = strings.ToLower(strings.TrimSpace(l.Format))
+	switch l.Format {
+	case "":
+		l.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("logging.format must be \"text\" or \"json\", got %q", l.Format)
+	}
+	if l.MaxSizeMB <= 0 {
+		l.MaxSizeMB = 10
+	}
+	if l.MaxBackups <= 0 {
+		l.MaxBackups = 5
+	}
+	return nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("logging.level must be \"debug\", \"info\", \"warn\" or \"error\", got %q", s)
+}
+
+// setupLogging replaces the default console logger with the configured one. The returned closer closes
+// the log file and is nil when there is none.
+func setupLogging(l LoggingConfig) (io.Closer, error) {
+	level, err := parseLogLevel(l.Level)
+	if err != nil {
+		return nil, err
+	}
+	var handlers []slog.Handler
+	if l.Console == nil || *l.Console {
+		handlers = append(handlers, newConsoleHandler(os.Stdout, l.Format, level))
+	}
+	var file *rotatingFile
+	if l.File != "" {
+		file, err = openRotatingFile(l.File, int64(l.MaxSizeMB)*1024*1024, l.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open log file: %v", err)
+		}
+		opts := &slog.HandlerOptions{Level: level}
+		if l.Format == "json" {
+			handlers = append(handlers, slog.NewJSONHandler(file, opts))
+		} else {
+			handlers = append(handlers, slog.NewTextHandler(file, opts))
+		}
+	}
+	logger = slog.New(teeHandler(handlers))
+	// Messages of the standard log package end up in the same outputs
+	slog.SetDefault(logger)
+	if file == nil {
+		return nil, nil
+	}
+	return file, nil
+}
+
+// newConsoleHandler logs to the console without timestamps; the log file keeps them
+func newConsoleHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// pathAttr names a path after what it is, so all events about one file can be found by the same field:
+// "archive" for archives, "source" for files under source_folder and "path" otherwise
+func pathAttr(path string) slog.Attr {
+	switch {
+	case path == "":
+		return slog.Attr{}
+	case isArchiveFile(path):
+		return slog.String("archive", path)
+	case withinFolder(path, config.SourceFolder):
+		return slog.String("source", path)
+	}
+	return slog.String("path", path)
+}
+
+// withinFolder reports whether path is inside folder
+func withinFolder(path, folder string) bool {
+	if folder == "" {
+		return false
+	}
+	rel, err := filepath.Rel(folder, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// teeHandler passes every record to all handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// rotatingFile is an append-only log file that is renamed to file.1 (shifting older files up to
+// file.<backups>) once it would grow past maxBytes
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			// A failed rename keeps appending to the current file rather than losing events
+			fmt.Fprintf(os.Stderr, "log rotation of %s failed: %v\n", r.path, err)
+			if r.f == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts the backups and starts a new file
+func (r *rotatingFile) rotate() error {
+	_ = r.f.Close()
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	renameErr := os.Rename(r.path, r.path+".1")
+	if err := r.open(); err != nil {
+		r.f = nil
+		return err
+	}
+	return renameErr
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"iis-log-compressor/iislog"
+)
+
+// topCounterLimit bounds the number of distinct keys tracked for top lists. When exceeded,
+// the least frequent keys are pruned, so top lists are approximate for very high cardinality.
+const topCounterLimit = 50000
+
+// topListSize is the number of entries kept in the top URI and client IP lists
+const topListSize = 10
+
+// TrafficStats accumulates request statistics while log files are compressed
+type TrafficStats struct {
+	Requests      int64
+	Malformed     int64
+	BytesSent     int64
+	BytesReceived int64
+	First         time.Time
+	Last          time.Time
+
+	status    map[int]int64
+	timeTaken map[int64]int64 // milliseconds -> count, exact percentiles with bounded memory
+	uris      *topCounter
+	clients   *topCounter
+}
+
+// TrafficSummary is the serialisable form of TrafficStats stored in manifests and reports
+type TrafficSummary struct {
+	Requests       int64            `json:"requests"`
+	MalformedLines int64            `json:"malformed_lines"`
+	FirstRequest   time.Time        `json:"first_request,omitempty"`
+	LastRequest    time.Time        `json:"last_request,omitempty"`
+	StatusCodes    map[string]int64 `json:"status_codes"`
+	TopURIs        []CountEntry     `json:"top_uris"`
+	TopClientIPs   []CountEntry     `json:"top_client_ips"`
+	BytesSent      int64            `json:"bytes_sent"`
+	BytesReceived  int64            `json:"bytes_received"`
+	TimeTakenP50Ms int64            `json:"time_taken_p50_ms"`
+	TimeTakenP95Ms int64            `json:"time_taken_p95_ms"`
+	TimeTakenP99Ms int64            `json:"time_taken_p99_ms"`
+}
+
+// CountEntry is a key with its number of occurrences
+type CountEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// topCounter counts keys, pruning rare ones to stay under topCounterLimit
+type topCounter struct {
+	counts map[string]int64
+}
+
+func newTopCounter() *topCounter {
+	return &topCounter{counts: make(map[string]int64)}
+}
+
+func (c *topCounter) add(key string, n int64) {
+	c.counts[key] += n
+	if len(c.counts) <= topCounterLimit {
+		return
+	}
+	for floor := int64(1); len(c.counts) > topCounterLimit/2; floor++ {
+		for k, v := range c.counts {
+			if v <= floor {
+				delete(c.counts, k)
+			}
+		}
+	}
+}
+
+func (c *topCounter) top(n int) []CountEntry {
+	list := make([]CountEntry, 0, len(c.counts))
+	for k, v := range c.counts {
+		list = append(list, CountEntry{Key: k, Count: v})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// newTrafficStats returns empty statistics
+func newTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		status:    make(map[int]int64),
+		timeTaken: make(map[int64]int64),
+		uris:      newTopCounter(),
+		clients:   newTopCounter(),
+	}
+}
+
+// Add counts a single request
+func (t *TrafficStats) Add(rec *iislog.Record) {
+	t.Requests++
+	if !rec.Time.IsZero() {
+		if t.First.IsZero() || rec.Time.Before(t.First) {
+			t.First = rec.Time
+		}
+		if rec.Time.After(t.Last) {
+			t.Last = rec.Time
+		}
+	}
+	if rec.Get(iislog.FieldStatus) != "" {
+		t.status[rec.Status]++
+	}
+	if rec.URIStem != "" {
+		t.uris.add(rec.URIStem, 1)
+	}
+	if rec.ClientIP != "" {
+		t.clients.add(rec.ClientIP, 1)
+	}
+	t.BytesSent += rec.BytesSent
+	t.BytesReceived += rec.BytesReceived
+	if rec.Get(iislog.FieldTimeTaken) != "" {
+		t.timeTaken[rec.TimeTaken.Milliseconds()]++
+	}
+}
+
+// Merge adds the counts of o into t
+func (t *TrafficStats) Merge(o *TrafficStats) {
+	t.Requests += o.Requests
+	t.Malformed += o.Malformed
+	t.BytesSent += o.BytesSent
+	t.BytesReceived += o.BytesReceived
+	if !o.First.IsZero() && (t.First.IsZero() || o.First.Before(t.First)) {
+		t.First = o.First
+	}
+	if o.Last.After(t.Last) {
+		t.Last = o.Last
+	}
+	for k, v := range o.status {
+		t.status[k] += v
+	}
+	for k, v := range o.timeTaken {
+		t.timeTaken[k] += v
+	}
+	for k, v := range o.uris.counts {
+		t.uris.add(k, v)
+	}
+	for k, v := range o.clients.counts {
+		t.clients.add(k, v)
+	}
+}
+
+// percentiles returns the time-taken values in milliseconds at each requested percentile
+func (t *TrafficStats) percentiles(ps ...float64) []int64 {
+	result := make([]int64, len(ps))
+	var total int64
+	values := make([]int64, 0, len(t.timeTaken))
+	for v, n := range t.timeTaken {
+		values = append(values, v)
+		total += n
+	}
+	if total == 0 {
+		return result
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	for i, p := range ps {
+		rank := int64(p / 100 * float64(total))
+		if rank >= total {
+			rank = total - 1
+		}
+		var seen int64
+		for _, v := range values {
+			seen += t.timeTaken[v]
+			if seen > rank {
+				result[i] = v
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Summary returns the serialisable form of the statistics
+func (t *TrafficStats) Summary() *TrafficSummary {
+	p := t.percentiles(50, 95, 99)
+	s := &TrafficSummary{
+		Requests:       t.Requests,
+		MalformedLines: t.Malformed,
+		FirstRequest:   t.First,
+		LastRequest:    t.Last,
+		StatusCodes:    make(map[string]int64, len(t.status)),
+		TopURIs:        t.uris.top(topListSize),
+		TopClientIPs:   t.clients.top(topListSize),
+		BytesSent:      t.BytesSent,
+		BytesReceived:  t.BytesReceived,
+		TimeTakenP50Ms: p[0],
+		TimeTakenP95Ms: p[1],
+		TimeTakenP99Ms: p[2],
+	}
+	for code, n := range t.status {
+		s.StatusCodes[strconv.Itoa(code)] = n
+	}
+	return s
+}
+
+// StatusClasses groups the status histogram into 2xx, 3xx, 4xx and 5xx counts
+func (s *TrafficSummary) StatusClasses() string {
+	classes := make(map[string]int64)
+	for code, n := range s.StatusCodes {
+		if code != "" {
+			classes[code[:1]+"xx"] += n
+		}
+	}
+	keys := make([]string, 0, len(classes))
+	for k := range classes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, classes[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatTop renders a top list as "key (count), ..."
+func formatTop(list []CountEntry, n int) string {
+	parts := make([]string, 0, n)
+	for i, e := range list {
+		if i >= n {
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s (%d)", e.Key, e.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// teeRecords copies src into dst while parsing the copied bytes and passing each record to fn.
+// It returns the number of lines that could not be parsed.
+func teeRecords(dst io.Writer, src io.Reader, fn func(*iislog.Record)) (int64, error) {
+	tee := io.TeeReader(src, dst)
+	lr := iislog.NewReader(tee)
+	for lr.Next() {
+		fn(lr.Record())
+	}
+	malformed := int64(lr.Malformed())
+	if err := lr.Err(); err != nil && err != bufio.ErrTooLong {
+		return malformed, err
+	}
+	// Copy whatever the parser did not consume, e.g. after an over-long line
+	_, err := io.Copy(io.Discard, tee)
+	return malformed, err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-log-compressor/iislog"
+)
+
+// testTrafficStats counts W3C log lines with the fields date time c-ip cs-uri-stem sc-status sc-bytes time-taken
+func testTrafficStats(t *testing.T, lines ...string) *TrafficStats {
+	t.Helper()
+	ts := newTrafficStats()
+	lr := iislog.NewReader(strings.NewReader("#Fields: date time c-ip cs-uri-stem sc-status sc-bytes time-taken\r\n" +
+		strings.Join(lines, "\r\n")))
+	for lr.Next() {
+		ts.Add(lr.Record())
+	}
+	if err := lr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	ts.Malformed = int64(lr.Malformed())
+	return ts
+}
+
+func TestTrafficPercentiles(t *testing.T) {
+	var spread []string
+	for ms := 1; ms <= 100; ms++ {
+		spread = append(spread, fmt.Sprintf("2024-05-03 10:00:00 10.0.0.1 /a 200 1 %d", ms))
+	}
+	tests := []struct {
+		name  string
+		lines []string
+		want  [3]int64
+	}{
+		{"empty", nil, [3]int64{0, 0, 0}},
+		{"single record", []string{"2024-05-03 10:00:00 10.0.0.1 /a 200 1 7"}, [3]int64{7, 7, 7}},
+		{"1 to 100 ms", spread, [3]int64{51, 96, 100}},
+		{"skewed", []string{
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 5",
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 5",
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 5",
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 9000",
+		}, [3]int64{5, 9000, 9000}},
+		// Records without time-taken are not counted as 0 ms
+		{"null time-taken", []string{
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 -",
+			"2024-05-03 10:00:00 10.0.0.1 /a 200 1 40",
+		}, [3]int64{40, 40, 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testTrafficStats(t, tt.lines...).Summary()
+			got := [3]int64{s.TimeTakenP50Ms, s.TimeTakenP95Ms, s.TimeTakenP99Ms}
+			if got != tt.want {
+				t.Errorf("p50/p95/p99 = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficSummary(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		wantReqs    int64
+		wantBytes   int64
+		wantClasses string
+		wantTopURI  string
+		wantTopIP   string
+		wantFirst   time.Time
+		wantLast    time.Time
+	}{
+		{name: "empty"},
+		{
+			name:        "single record",
+			lines:       []string{"2024-05-03 10:00:00 10.0.0.1 /a 404 100 3"},
+			wantReqs:    1,
+			wantBytes:   100,
+			wantClasses: "4xx: 1",
+			wantTopURI:  "/a (1)",
+			wantTopIP:   "10.0.0.1 (1)",
+			wantFirst:   time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC),
+			wantLast:    time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "several records",
+			lines: []string{
+				"2024-05-03 10:00:05 10.0.0.2 /b 200 10 1",
+				"2024-05-03 10:00:01 10.0.0.1 /a 200 20 1",
+				"2024-05-03 10:00:09 10.0.0.2 /b 301 - 1",
+				"2024-05-03 10:00:03 10.0.0.3 /c 500 30 1",
+				"2024-05-03 10:00:04 10.0.0.2 /b 503 40 1",
+			},
+			wantReqs:    5,
+			wantBytes:   100,
+			wantClasses: "2xx: 2, 3xx: 1, 5xx: 2",
+			// Ties are listed by key
+			wantTopURI: "/b (3), /a (1), /c (1)",
+			wantTopIP:  "10.0.0.2 (3), 10.0.0.1 (1), 10.0.0.3 (1)",
+			wantFirst:  time.Date(2024, 5, 3, 10, 0, 1, 0, time.UTC),
+			wantLast:   time.Date(2024, 5, 3, 10, 0, 9, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testTrafficStats(t, tt.lines...).Summary()
+			if s.Requests != tt.wantReqs || s.BytesSent != tt.wantBytes {
+				t.Errorf("requests %d, bytes %d, want %d and %d", s.Requests, s.BytesSent, tt.wantReqs, tt.wantBytes)
+			}
+			if got := s.StatusClasses(); got != tt.wantClasses {
+				t.Errorf("status classes %q, want %q", got, tt.wantClasses)
+			}
+			if got := formatTop(s.TopURIs, 3); got != tt.wantTopURI {
+				t.Errorf("top URIs %q, want %q", got, tt.wantTopURI)
+			}
+			if got := formatTop(s.TopClientIPs, 3); got != tt.wantTopIP {
+				t.Errorf("top client IPs %q, want %q", got, tt.wantTopIP)
+			}
+			if !s.FirstRequest.Equal(tt.wantFirst) || !s.LastRequest.Equal(tt.wantLast) {
+				t.Errorf("requests from %s to %s, want %s to %s", s.FirstRequest, s.LastRequest, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestTrafficTopList(t *testing.T) {
+	var lines []string
+	// /u0 is requested once, /u1 twice, ... so the top list is /u14 down to /u5
+	for i := 0; i < 15; i++ {
+		for n := 0; n <= i; n++ {
+			lines = append(lines, fmt.Sprintf("2024-05-03 10:00:00 10.0.0.1 /u%d 200 1 1", i))
+		}
+	}
+	top := testTrafficStats(t, lines...).Summary().TopURIs
+	if len(top) != topListSize {
+		t.Fatalf("%d top URIs, want %d", len(top), topListSize)
+	}
+	if top[0] != (CountEntry{Key: "/u14", Count: 15}) || top[topListSize-1] != (CountEntry{Key: "/u5", Count: 6}) {
+		t.Errorf("top URIs = %v", top)
+	}
+}
+
+func TestTrafficMerge(t *testing.T) {
+	a := testTrafficStats(t,
+		"2024-05-03 10:00:00 10.0.0.1 /a 200 10 5",
+		"2024-05-03 11:00:00 10.0.0.1 /a 404 20 5")
+	b := testTrafficStats(t,
+		"2024-05-02 09:00:00 10.0.0.2 /b 200 30 100",
+		"2024-05-04 08:00:00 10.0.0.2 /a 500 40 100",
+		"not a log line")
+
+	total := newTrafficStats()
+	total.Merge(a)
+	total.Merge(b)
+	// Merging empty statistics changes nothing
+	total.Merge(newTrafficStats())
+
+	s := total.Summary()
+	if s.Requests != 4 || s.MalformedLines != 1 || s.BytesSent != 100 {
+		t.Errorf("requests %d, malformed %d, bytes %d, want 4, 1 and 100", s.Requests, s.MalformedLines, s.BytesSent)
+	}
+	if want := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC); !s.FirstRequest.Equal(want) {
+		t.Errorf("first request %s, want %s", s.FirstRequest, want)
+	}
+	if want := time.Date(2024, 5, 4, 8, 0, 0, 0, time.UTC); !s.LastRequest.Equal(want) {
+		t.Errorf("last request %s, want %s", s.LastRequest, want)
+	}
+	if s.StatusCodes["200"] != 2 || s.StatusCodes["404"] != 1 || s.StatusCodes["500"] != 1 {
+		t.Errorf("status codes %v", s.StatusCodes)
+	}
+	if got := formatTop(s.TopURIs, 2); got != "/a (3), /b (1)" {
+		t.Errorf("top URIs %q", got)
+	}
+	if s.TimeTakenP50Ms != 100 || s.TimeTakenP95Ms != 100 {
+		t.Errorf("p50 %d, p95 %d, want 100 from the merged time-taken counts", s.TimeTakenP50Ms, s.TimeTakenP95Ms)
+	}
+}
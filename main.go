@@ -3,51 +3,101 @@ package main
 import (
 	"archive/zip"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net"
-	"net/smtp"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"iis-log-compressor/iislog"
 )
 
 const toolName = "IIS Log compressor by Nader Barakat . www.naderb.org tools"
 
+// Process exit codes of a run, for schedulers and monitoring agents
+const (
+	exitSuccess       = 0 // every group archived without errors or warnings
+	exitFailed        = 1 // errors were recorded, or warnings with --fail-on-warnings
+	exitWarnings      = 2 // archived, but warnings were recorded
+	exitNothingToDo   = 3 // no log file was old enough to archive
+	exitLockHeld      = 4 // another instance holds the lock in dest_folder
+	exitInvalidConfig = 5 // config.json or the command line is invalid
+	exitCancelled     = 6 // the run was cancelled by Ctrl+C or a service stop
+)
+
 // Config holds all configuration settings
 type Config struct {
-	SourceFolder                string      `json:"source_folder"`
-	DestFolder                  string      `json:"dest_folder"`
-	LogAgeDays                  int         `json:"log_age_days"`
-	RetentionDays               int         `json:"retention_days"`
-	CleanupOldLogs              bool        `json:"cleanup_old_logs"`
-	DeleteOriginalAfterCompress bool        `json:"delete_original_after_compress"`
-	CompressCurrentMonth        bool        `json:"compress_current_month"`
-	ArchiveScope                string      `json:"archive_scope"`
-	KeepLastNArchives           int         `json:"keep_last_n_archives"`
-	DestFileNamePattern         string      `json:"dest_file_name_pattern"`
-	CompressionType             string      `json:"compression_type"`
-	MaxCPUs                     int         `json:"max_cpus"`
-	EmailNotification           EmailConfig `json:"email_notification"`
+	SourceFolder                string               `json:"source_folder"`
+	DestFolder                  string               `json:"dest_folder"`
+	LogAgeDays                  int                  `json:"log_age_days"`
+	RetentionDays               int                  `json:"retention_days"`
+	CleanupOldLogs              bool                 `json:"cleanup_old_logs"`
+	DeleteOriginalAfterCompress bool                 `json:"delete_original_after_compress"`
+	CompressCurrentMonth        bool                 `json:"compress_current_month"`
+	ArchiveScope                string               `json:"archive_scope"`
+	KeepLastNArchives           int                  `json:"keep_last_n_archives"`
+	DestFileNamePattern         string               `json:"dest_file_name_pattern"`
+	CompressionType             string               `json:"compression_type"`
+	MaxCPUs                     int                  `json:"max_cpus"`
+	TrafficStats                bool                 `json:"traffic_stats"`
+	Redaction                   RedactionConfig      `json:"redaction"`
+	Parquet                     ParquetConfig        `json:"parquet"`
+	NDJSON                      NDJSONConfig         `json:"ndjson"`
+	RemoteTargets               []RemoteTargetConfig `json:"remote_targets"`
+	DeleteLocalAfterUpload      bool                 `json:"delete_local_after_upload"`
+	PostArchiveCommand          HookCommand          `json:"post_archive_command"`
+	PostRunCommand              HookCommand          `json:"post_run_command"`
+	Webhooks                    []WebhookConfig      `json:"webhooks"`
+	ReportDir                   string               `json:"report_dir"`
+	ReportRetentionDays         int                  `json:"report_retention_days"`
+	MetricsFile                 string               `json:"metrics_file"`
+	HistoryFile                 string               `json:"history_file"`
+	Logging                     LoggingConfig        `json:"logging"`
+	Serve                       ServeConfig          `json:"serve"`
+	LockStaleHours              int                  `json:"lock_stale_hours"` // age after which a lock whose process cannot be checked is stale; 0 never
+	EmailNotification           EmailConfig          `json:"email_notification"`
 }
 
 // EmailConfig holds email notification settings
 type EmailConfig struct {
-	Enabled  bool   `json:"enabled"`
-	SMTPHost string `json:"smtp_host"`
-	SMTPPort int    `json:"smtp_port"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	From     string `json:"from"`
-	To       string `json:"to"`
-	Subject  string `json:"subject"`
+	Enabled            bool         `json:"enabled"`
+	SMTPHost           string       `json:"smtp_host"`
+	SMTPPort           int          `json:"smtp_port"`       // default 465 for implicit TLS, 25 for none, otherwise 587
+	TLSMode            string       `json:"tls_mode"`        // "auto" (default), "implicit", "starttls" or "none"
+	CAFile             string       `json:"ca_file"`         // extra PEM root certificates for the SMTP server
+	TLSServerName      string       `json:"tls_server_name"` // certificate name when it differs from smtp_host
+	InsecureSkipVerify bool         `json:"insecure_skip_verify"`
+	Username           string       `json:"username"` // empty sends without authentication
+	Password           string       `json:"password"`
+	AuthMechanism      string       `json:"auth_mechanism"`      // "plain" (default) or "login"
+	AllowInsecureAuth  bool         `json:"allow_insecure_auth"` // send credentials without TLS
+	HeloName           string       `json:"helo_name"`
+	DialTimeoutSeconds int          `json:"dial_timeout_seconds"` // default 10
+	TimeoutSeconds     int          `json:"timeout_seconds"`      // whole SMTP conversation, default 60
+	From               string       `json:"from"`
+	To                 addressList  `json:"to"` // list, or a comma / semicolon separated string
+	Cc                 addressList  `json:"cc"`
+	Bcc                addressList  `json:"bcc"`
+	OnlyOn             string       `json:"only_on"` // "always" (default), "warnings" (warnings or failures) or "failure"
+	Routes             []EmailRoute `json:"routes"`  // per-status recipients, first match wins
+	Subject            string       `json:"subject"`
+	HTMLTemplate       string       `json:"html_template"` // html/template file; empty uses the built-in template
+	TextTemplate       string       `json:"text_template"` // text/template file for the plain-text part
+	AttachReport       bool         `json:"attach_report"`
+	AttachManifests    bool         `json:"attach_manifests"`
+	MaxAttachmentMB    int          `json:"max_attachment_mb"` // total size of the attachments, default 10
 }
 
 // CompressionStats holds statistics about compression operations
@@ -57,10 +107,20 @@ type CompressionStats struct {
 	TotalSizeBefore int64
 	TotalSizeAfter  int64
 	Errors          []string
+	Warnings        []string
+	Manifests       []*Manifest
 	StartTime       time.Time
 	EndTime         time.Time
 	EmailStatus     string
 	GroupCount      int
+	Traffic         *TrafficStats
+	Uploads         []UploadResult
+	Groups          []*GroupResult
+	Issues          []RunIssue
+	Retention       []RetentionAction
+	Notifications   []NotificationResult
+	Phases          []PhaseTiming
+	Cancelled       bool // the run was interrupted by a signal
 }
 
 // LogFile represents a log file to be processed
@@ -68,23 +128,112 @@ type LogFile struct {
 	Path    string
 	Size    int64
 	ModTime time.Time
+	Format  iislog.Format
 }
 
 var (
-	config Config
-	stats  CompressionStats
-	mu     sync.Mutex
+	config    Config
+	stats     CompressionStats
+	mu        sync.Mutex
+	redaction *redactor      // nil unless redaction is enabled
+	remotes   []remoteTarget // built from remote_targets
 )
 
 func main() {
+	// grep and export output is meant for pipes, so they skip the banner
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "grep":
+			os.Exit(runGrep(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		}
+	}
+
 	fmt.Println(toolName)
 	fmt.Println("========================")
 
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "extract":
+			os.Exit(runExtract(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "serve":
+			os.Exit(runServe(os.Args[2:]))
+		}
+	}
+
+	os.Exit(runOnce(os.Args[1:]))
+}
+
+// runOnce performs a single archiving run with config.json and returns the process exit code
+func runOnce(args []string) int {
+	fs := flag.NewFlagSet("iis-log-compressor", flag.ContinueOnError)
+	failOnWarnings := fs.Bool("fail-on-warnings", false, "exit with the failure code when the run has warnings")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitInvalidConfig
+	}
+	if fs.NArg() > 0 {
+		// A mistyped subcommand such as "verfiy" must not start a full archiving run
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", fs.Arg(0))
+		fmt.Fprintln(os.Stderr, "usage: iis-log-compressor [-fail-on-warnings] | serve | verify | extract | grep | export | history")
+		return exitInvalidConfig
+	}
+
 	// Load configuration
 	if err := loadConfig("config.json"); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		logger.Error("failed to load config", "error", err)
+		return exitInvalidConfig
+	}
+	if err := setupRemoteTargets(); err != nil {
+		logger.Error("failed to load config", "error", err)
+		return exitInvalidConfig
+	}
+	logFile, err := setupLogging(config.Logging)
+	if err != nil {
+		logger.Error("failed to set up logging", "error", err)
+		return exitInvalidConfig
 	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	lock, err := acquireRunLock("run")
+	if err != nil {
+		if isLockHeld(err) {
+			logger.Warn("not running: " + err.Error())
+			return exitLockHeld
+		}
+		logger.Error("failed to acquire lock", "error", err)
+		return exitFailed
+	}
+	// Ctrl+C or a service stop cancels the run; a second signal terminates at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		logger.Warn("interrupted, cancelling the run")
+	}()
+	runArchive(ctx)
+	stop()
+	lock.Release()
+
+	code := runExitCode(*failOnWarnings)
+	logger.Info("exiting", "exit_code", code)
+	return code
+}
 
+// runArchive performs one archiving run with the loaded configuration: compression, retention, hooks,
+// notifications and reports. Cancelling ctx aborts discovery, compression, post-archive hooks, uploads and
+// retention; partial archives are removed and the run is reported with the status "cancelled".
+func runArchive(ctx context.Context) {
 	// Set CPU limit
 	if config.MaxCPUs > 0 && config.MaxCPUs <= runtime.NumCPU() {
 		runtime.GOMAXPROCS(config.MaxCPUs)
@@ -92,49 +241,97 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
 
-	fmt.Printf("Using %d CPUs for processing\n", runtime.GOMAXPROCS(0))
+	logger.Info("run started", "cpus", runtime.GOMAXPROCS(0), "source_folder", config.SourceFolder,
+		"dest_folder", config.DestFolder, "archive_scope", strings.ToLower(config.ArchiveScope))
 
 	// Initialize stats
 	stats = CompressionStats{
 		StartTime: time.Now(),
 		Errors:    make([]string, 0),
 	}
+	if config.TrafficStats {
+		stats.Traffic = newTrafficStats()
+	}
 
 	// Process logs
-	if err := processLogs(); err != nil {
-		log.Printf("Error processing logs: %v", err)
-		stats.Errors = append(stats.Errors, err.Error())
+	if err := processLogs(ctx); err != nil && ctx.Err() == nil {
+		addError("process_failed", "", "", err.Error())
 	}
 
-	// Cleanup old compressed logs if enabled
-	if config.CleanupOldLogs {
-		if err := cleanupOldCompressedLogs(); err != nil {
-			log.Printf("Error cleaning up old logs: %v", err)
-			stats.Errors = append(stats.Errors, err.Error())
+	// Cleanup old compressed logs if enabled; skipped when cancelled
+	if config.CleanupOldLogs && ctx.Err() == nil {
+		phaseStart := time.Now()
+		if err := cleanupOldCompressedLogs(ctx); err != nil && ctx.Err() == nil {
+			addError("retention_failed", "", config.DestFolder, err.Error())
 		}
+		recordPhase("retention", phaseStart)
+	}
+
+	// Remote retention and connection shutdown
+	if len(remotes) > 0 {
+		phaseStart := time.Now()
+		finishRemoteTargets(ctx)
+		recordPhase("remote_retention", phaseStart)
 	}
+	if ctx.Err() != nil {
+		stats.Cancelled = true
+		logger.Warn("run cancelled")
+	}
+	// Hooks and notifications still report a cancelled run
+	reportCtx := context.WithoutCancel(ctx)
 
 	// Finalize stats
 	stats.EndTime = time.Now()
 
-	// Print summary
-	printSummary()
+	// External post-run command; its failure is part of the summary, email and report
+	if config.PostRunCommand.Command != "" {
+		phaseStart := time.Now()
+		runPostRunHook(reportCtx)
+		recordPhase("post_run_hook", phaseStart)
+	}
+
+	// Print summary; with JSON logging the console only carries log events
+	logRunFinished()
+	if config.Logging.Format != "json" {
+		printSummary()
+	}
+
+	// Post the run summary to the configured webhooks
+	notifyStart := time.Now()
+	sendWebhooks(reportCtx)
 
 	// Send email notification if enabled
 	if config.EmailNotification.Enabled {
-		if err := sendEmailNotification(); err != nil {
+		if rcpts, reason := selectEmailRecipients(config.EmailNotification, runStatus()); reason != "" {
+			stats.EmailStatus = "Email skipped: " + reason
+			recordNotification("email", "email", "skipped", reason)
+		} else if err := sendEmailNotification(reportCtx, rcpts); err != nil {
 			stats.EmailStatus = fmt.Sprintf("Email send failed: %v", err)
-			log.Printf("Failed to send email notification: %v", err)
+			recordNotification("email", "email", "failed", err.Error())
 		} else {
-			stats.EmailStatus = "Email sent successfully"
+			stats.EmailStatus = fmt.Sprintf("Email sent successfully to %d recipient(s)", len(rcpts.envelope()))
+			recordNotification("email", "email", "sent", strings.Join(rcpts.envelope(), ", "))
 		}
 	} else {
 		stats.EmailStatus = "Email disabled"
+		recordNotification("email", "email", "disabled", "")
 	}
+	recordPhase("notifications", notifyStart)
 
 	// Write run report next to exe
 	if err := writeRunReport(); err != nil {
-		log.Printf("Failed to write run report: %v", err)
+		logger.Error("failed to write run report", "error", err)
+	}
+	if path, err := writeJSONReport(); err != nil {
+		logger.Error("failed to write JSON run report", "error", err)
+	} else if path != "" {
+		logger.Info("JSON run report written", "path", path)
+	}
+	if err := appendHistory(); err != nil {
+		logger.Error("failed to append run history", "path", config.HistoryFile, "error", err)
+	}
+	if err := writeMetricsFile(); err != nil {
+		logger.Error("failed to write metrics file", "path", config.MetricsFile, "error", err)
 	}
 }
 
@@ -176,28 +373,63 @@ func loadConfig(filename string) error {
 	if config.KeepLastNArchives < 0 {
 		config.KeepLastNArchives = 0
 	}
+	validateReportConfig()
+	if err := validateLoggingConfig(&config.Logging); err != nil {
+		return err
+	}
+	if err := validateServeConfig(&config.Serve); err != nil {
+		return err
+	}
+	if err := validateMetricsConfig(); err != nil {
+		return err
+	}
+	if err := validateParquetConfig(&config.Parquet); err != nil {
+		return err
+	}
+	if err := validateNDJSONConfig(&config.NDJSON); err != nil {
+		return err
+	}
+	if err := validateEmailConfig(&config.EmailNotification); err != nil {
+		return err
+	}
+	if err := validateWebhooks(config.Webhooks); err != nil {
+		return err
+	}
+	if config.Redaction.Enabled {
+		r, err := newRedactor(config.Redaction)
+		if err != nil {
+			return err
+		}
+		redaction = r
+	}
 
 	return nil
 }
 
-func processLogs() error {
+func processLogs(ctx context.Context) error {
 	// Create destination folder if it doesn't exist
 	if err := os.MkdirAll(config.DestFolder, 0755); err != nil {
 		return fmt.Errorf("failed to create destination folder: %v", err)
 	}
 
 	// Find log files
-	logFiles, err := findLogFiles()
+	discoveryStart := time.Now()
+	logFiles, err := findLogFiles(ctx)
+	recordPhase("discovery", discoveryStart)
+	if ctx.Err() != nil {
+		logger.Warn("discovery cancelled", "files", len(logFiles))
+		return ctx.Err()
+	}
 	if err != nil {
 		return fmt.Errorf("failed to find log files: %v", err)
 	}
 
 	if len(logFiles) == 0 {
-		fmt.Println("No log files found matching criteria")
+		logger.Info("no log files found matching criteria")
 		return nil
 	}
 
-	fmt.Printf("Found %d log files to process\n", len(logFiles))
+	logger.Info("log files found", "files", len(logFiles))
 
 	// Group files by scope
 	groups := make(map[string][]LogFile)
@@ -218,6 +450,7 @@ func processLogs() error {
 	stats.GroupCount = len(groups)
 
 	// Compress each group in parallel
+	compressStart := time.Now()
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, runtime.GOMAXPROCS(0))
 	for gk, files := range groups {
@@ -228,16 +461,33 @@ func processLogs() error {
 			defer wg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
-
-			if err := compressMonthGroup(gk, files); err != nil {
+			if ctx.Err() != nil {
+				logger.Warn("run cancelled, group not started", "group", gk, "files", len(files))
 				mu.Lock()
-				stats.Errors = append(stats.Errors, fmt.Sprintf("Error compressing group %s: %v", gk, err))
+				stats.Groups = append(stats.Groups, &GroupResult{Group: gk, FilesFound: len(files), Verify: "skipped",
+					Error: "cancelled"})
 				mu.Unlock()
+				return
+			}
+
+			start := time.Now()
+			res := &GroupResult{Group: gk, FilesFound: len(files), Verify: "skipped", Sites: siteVolumes(files)}
+			if err := compressMonthGroup(ctx, gk, files, res); errors.Is(err, context.Canceled) {
+				res.Error = "cancelled"
+				logger.Warn("group cancelled", "group", gk, pathAttr(res.Archive))
+			} else if err != nil {
+				res.Error = err.Error()
+				addError("group_failed", gk, res.Archive, fmt.Sprintf("Error compressing group %s: %v", gk, err))
 			}
+			res.DurationSeconds = time.Since(start).Seconds()
+			mu.Lock()
+			stats.Groups = append(stats.Groups, res)
+			mu.Unlock()
 		}()
 	}
 
 	wg.Wait()
+	recordPhase("compress", compressStart)
 	return nil
 }
 
@@ -274,8 +524,10 @@ func generateArchiveFileName(ref time.Time) string {
 	return pattern + getCompressionExtension()
 }
 
-// compressMonthGroup creates a single archive for all files in a given group key (month or day)
-func compressMonthGroup(groupKey string, files []LogFile) error {
+// compressMonthGroup creates a single archive for all files in a given group key (month or day) and
+// records the outcome in res. When ctx is cancelled before the archive is complete the partial output is
+// removed and ctx.Err() is returned.
+func compressMonthGroup(ctx context.Context, groupKey string, files []LogFile, res *GroupResult) error {
 	if len(files) == 0 {
 		return nil
 	}
@@ -284,6 +536,13 @@ func compressMonthGroup(groupKey string, files []LogFile) error {
 	destFileName := generateArchiveFileName(ref)
 	destPath := filepath.Join(config.DestFolder, destFileName)
 
+	// Parquet replaces the zip entirely
+	if config.Parquet.Mode == "replace" {
+		res.Archive = config.Parquet.Folder
+		return convertGroupToParquet(ctx, strings.TrimSuffix(destFileName, filepath.Ext(destFileName)), files, res)
+	}
+	res.Archive = destPath
+
 	// Create destination file
 	destFile, err := os.Create(destPath)
 	if err != nil {
@@ -292,8 +551,8 @@ func compressMonthGroup(groupKey string, files []LogFile) error {
 
 	switch strings.ToLower(config.CompressionType) {
 	case "zip":
-		added, err := addFilesToZip(destFile, files, destPath)
-		if err != nil {
+		manifest := newManifest(destPath, groupKey)
+		if err := addFilesToZip(ctx, destFile, files, destPath, manifest); err != nil {
 			_ = destFile.Close()
 			_ = os.Remove(destPath)
 			return err
@@ -302,23 +561,68 @@ func compressMonthGroup(groupKey string, files []LogFile) error {
 		if err := destFile.Close(); err != nil {
 			return fmt.Errorf("closing destination file: %v", err)
 		}
+		// Record archive checksum for later integrity audits
+		if err := writeChecksumSidecar(destPath); err != nil {
+			addError("checksum_failed", groupKey, destPath, err.Error())
+		}
+		if err := writeManifest(destPath, manifest); err != nil {
+			addError("manifest_failed", groupKey, destPath, err.Error())
+		}
+		res.Files = len(manifest.Entries)
+		for _, e := range manifest.Entries {
+			res.BytesBefore += e.Size
+		}
+		mu.Lock()
+		stats.Manifests = append(stats.Manifests, manifest)
+		mu.Unlock()
 		// Verify zip content before any deletion
-		verified := verifyZipContainsAll(destPath, added)
+		verified := verifyZipContainsAll(destPath, manifest.Entries)
+		res.Verify = "ok"
+		for path, ok := range verified {
+			if !ok {
+				res.Verify = "failed"
+				addError("verify_failed", groupKey, path, fmt.Sprintf("verify %s: %s missing or incomplete in archive", destPath, path))
+				continue
+			}
+			res.VerifiedFiles++
+		}
+		logger.Info("archive verified", "group", groupKey, "archive", destPath, "verify", res.Verify,
+			"verified_files", res.VerifiedFiles, "files", len(manifest.Entries))
+		// Deletion is not interrupted by a cancel: the verified archive stays and a later run would
+		// replace it with one that lacks the originals already removed
 		if config.DeleteOriginalAfterCompress {
 			for path, ok := range verified {
 				if ok {
 					if err := deleteWithRetry(path, 3, 500*time.Millisecond); err != nil {
-						fmt.Printf("Warning: Failed to remove original file %s: %v\n", path, err)
+						addWarning("delete_failed", path, "Failed to remove original file %s: %v", path, err)
+					} else {
+						res.Deleted++
+						logger.Info("original deleted", "group", groupKey, "archive", destPath, "source", path)
 					}
 				}
 			}
 		}
 		// Update compressed size
 		if info, err := os.Stat(destPath); err == nil {
+			res.BytesAfter = info.Size()
 			mu.Lock()
 			stats.TotalSizeAfter += info.Size()
 			mu.Unlock()
 		}
+		// External post-archive command, before any upload may remove the local copy
+		runPostArchiveHook(ctx, destPath, groupKey, files, manifest)
+		// Copy to remote targets; the local copy is only removed once every upload is confirmed
+		if len(remotes) > 0 {
+			res.Uploaded = uploadArchive(ctx, destPath, manifest)
+		}
+		if res.Uploaded && config.DeleteLocalAfterUpload {
+			if err := removeArchive(destPath); err != nil {
+				addWarning("delete_failed", destPath, "Failed to remove uploaded archive %s: %v", destPath, err)
+			} else {
+				res.LocalRemoved = true
+				logger.Info("local archive removed after upload", "group", groupKey, "archive", destPath)
+			}
+		}
 	case "gzip":
 		_ = destFile.Close()
 		_ = os.Remove(destPath)
@@ -332,7 +636,9 @@ func compressMonthGroup(groupKey string, files []LogFile) error {
 	return nil
 }
 
-func findLogFiles() ([]LogFile, error) {
+// findLogFiles walks source_folder for log files older than log_age_days, stopping with ctx.Err() when
+// ctx is cancelled
+func findLogFiles(ctx context.Context) ([]LogFile, error) {
 	var logFiles []LogFile
 	cutoffDate := time.Now().AddDate(0, 0, -config.LogAgeDays)
 
@@ -340,6 +646,9 @@ func findLogFiles() ([]LogFile, error) {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// Skip directories
 		if info.IsDir() {
@@ -354,10 +663,16 @@ func findLogFiles() ([]LogFile, error) {
 		// Check if it's a log file (common IIS log extensions)
 		ext := strings.ToLower(filepath.Ext(path))
 		if ext == ".log" || ext == ".txt" || strings.Contains(strings.ToLower(path), "log") {
+			// Detect W3C, IIS or NCSA format from the first lines
+			format, err := iislog.DetectFile(path)
+			if err != nil {
+				logger.Warn("failed to detect log format", "source", path, "error", err)
+			}
 			logFiles = append(logFiles, LogFile{
 				Path:    path,
 				Size:    info.Size(),
 				ModTime: info.ModTime(),
+				Format:  format,
 			})
 		}
 
@@ -372,39 +687,126 @@ func findLogFiles() ([]LogFile, error) {
 	return logFiles, err
 }
 
-// addFilesToZip writes all files into zip and returns the list of successfully added file paths
-func addFilesToZip(destFile *os.File, files []LogFile, destPath string) ([]string, error) {
+// copyLogFile copies a log file into an archive entry, redacting records when enabled and passing
+// every record to fn when it is not nil. It returns the bytes written and the number of lines that
+// could not be parsed; with redaction those lines are dropped from the output.
+func copyLogFile(dst io.Writer, src io.Reader, fn func(*iislog.Record)) (int64, int64, error) {
+	cw := &countingWriter{w: dst}
+	var malformed int64
+	var err error
+	switch {
+	case redaction != nil:
+		malformed, err = redactCopy(cw, src, redaction, fn)
+	case fn != nil:
+		malformed, err = teeRecords(cw, src, fn)
+	default:
+		_, err = io.Copy(cw, src)
+	}
+	return cw.n, malformed, err
+}
+
+// recordHandler combines the per-record consumers that are enabled, or returns nil if there are none
+func recordHandler(ts *TrafficStats, pq *parquetPartitions, nd *ndjsonWriter) func(*iislog.Record) {
+	if ts == nil && pq == nil && nd == nil {
+		return nil
+	}
+	return func(rec *iislog.Record) {
+		if ts != nil {
+			ts.Add(rec)
+		}
+		if pq != nil {
+			pq.Add(rec)
+		}
+		if nd != nil {
+			nd.Add(rec)
+		}
+	}
+}
+
+// addFilesToZip writes all files into zip and records the successfully added ones in the manifest. A
+// cancelled ctx stops it with ctx.Err() and discards the Parquet and NDJSON output of the group.
+func addFilesToZip(ctx context.Context, destFile *os.File, files []LogFile, destPath string, manifest *Manifest) error {
 	zipWriter := zip.NewWriter(destFile)
-	added := make([]string, 0, len(files))
+	entryIndex := 0
+	var traffic *TrafficStats
+	if config.TrafficStats {
+		traffic = newTrafficStats()
+	}
+	if redaction != nil {
+		manifest.Redaction = redaction.profile()
+	}
+	var pq *parquetPartitions
+	if config.Parquet.Mode == "alongside" {
+		pq = newParquetPartitions(strings.TrimSuffix(filepath.Base(destPath), filepath.Ext(destPath)))
+	}
+	nd := createAlongsideNDJSON(strings.TrimSuffix(filepath.Base(destPath), filepath.Ext(destPath)))
+	cancelled := func() error {
+		if pq != nil {
+			pq.abort()
+		}
+		if nd != nil {
+			nd.abort()
+		}
+		return ctx.Err()
+	}
 	for _, lf := range files {
+		if ctx.Err() != nil {
+			return cancelled()
+		}
 		// Open source
 		srcFile, err := os.Open(lf.Path)
 		if err != nil {
-			fmt.Printf("Warning: failed to open %s: %v\n", lf.Path, err)
-			mu.Lock()
-			stats.Errors = append(stats.Errors, fmt.Sprintf("open %s: %v", lf.Path, err))
-			mu.Unlock()
+			addError("open_failed", manifest.Group, lf.Path, fmt.Sprintf("open %s: %v", lf.Path, err))
 			continue
 		}
 		entryName := filepath.Base(lf.Path)
-		zw, err := zipWriter.Create(entryName)
+		// The entry keeps the file's time so extract and export can select it by time range
+		zw, err := zipWriter.CreateHeader(&zip.FileHeader{Name: entryName, Method: zip.Deflate, Modified: lf.ModTime})
 		if err != nil {
 			_ = srcFile.Close()
-			fmt.Printf("Warning: failed to create zip entry for %s: %v\n", lf.Path, err)
-			mu.Lock()
-			stats.Errors = append(stats.Errors, fmt.Sprintf("zip entry %s: %v", lf.Path, err))
-			mu.Unlock()
+			addError("zip_entry_failed", manifest.Group, lf.Path, fmt.Sprintf("zip entry %s: %v", lf.Path, err))
 			continue
 		}
-		if _, err := io.Copy(zw, srcFile); err != nil {
+		index := entryIndex
+		entryIndex++
+		var fileTraffic *TrafficStats
+		if traffic != nil {
+			fileTraffic = newTrafficStats()
+		}
+		if pq != nil {
+			pq.setSite(siteForPath(lf.Path))
+		}
+		if nd != nil {
+			nd.setSource(filepath.Base(destPath), entryName, siteForPath(lf.Path))
+		}
+		stored, malformed, err := copyLogFile(zw, &contextReader{ctx: ctx, r: srcFile}, recordHandler(fileTraffic, pq, nd))
+		if err != nil {
 			_ = srcFile.Close()
-			fmt.Printf("Warning: failed to copy %s into zip: %v\n", lf.Path, err)
-			mu.Lock()
-			stats.Errors = append(stats.Errors, fmt.Sprintf("zip copy %s: %v", lf.Path, err))
-			mu.Unlock()
+			if ctx.Err() != nil {
+				return cancelled()
+			}
+			if pq != nil {
+				pq.rollback()
+			}
+			addError("copy_failed", manifest.Group, lf.Path, fmt.Sprintf("zip copy %s: %v", lf.Path, err))
 			continue
 		}
 		_ = srcFile.Close()
+		if pq != nil {
+			if err := pq.commit(); err != nil {
+				addError("parquet_failed", manifest.Group, lf.Path, fmt.Sprintf("parquet %s: %v", lf.Path, err))
+			}
+		}
+		if fileTraffic != nil {
+			fileTraffic.Malformed += malformed
+			traffic.Merge(fileTraffic)
+		}
+		var dropped int64
+		if redaction != nil && malformed > 0 {
+			addWarning("malformed_lines", lf.Path, "dropped %d unparseable lines of %s during redaction, keeping the original", malformed, lf.Path)
+			manifest.Redaction.DroppedLines += malformed
+			dropped = malformed
+		}
 
 		mu.Lock()
 		stats.FilesProcessed++
@@ -412,46 +814,74 @@ func addFilesToZip(destFile *os.File, files []LogFile, destPath string) ([]strin
 		stats.TotalSizeBefore += lf.Size
 		mu.Unlock()
 
-		fmt.Printf("Added to %s: %s\n", destPath, lf.Path)
-		added = append(added, lf.Path)
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Index:        index,
+			Name:         entryName,
+			SourcePath:   lf.Path,
+			Site:         siteForPath(lf.Path),
+			Format:       lf.Format.String(),
+			Size:         lf.Size,
+			StoredSize:   stored,
+			DroppedLines: dropped,
+			ModTime:      lf.ModTime,
+		})
+
+		logger.Info("file added", "group", manifest.Group, "archive", destPath, "source", lf.Path,
+			"bytes", lf.Size, "stored_bytes", stored)
 	}
 	if err := zipWriter.Close(); err != nil {
-		return added, fmt.Errorf("closing zip writer: %v", err)
+		return fmt.Errorf("closing zip writer: %v", err)
+	}
+	if traffic != nil {
+		manifest.Traffic = traffic.Summary()
+		mu.Lock()
+		stats.Traffic.Merge(traffic)
+		mu.Unlock()
+	}
+	if pq != nil {
+		files, _, err := closeParquet(pq, manifest.Group)
+		if err != nil {
+			addError("parquet_failed", manifest.Group, destPath, fmt.Sprintf("parquet %s: %v", destPath, err))
+		}
+		manifest.Parquet = files
+	}
+	if nd != nil {
+		manifest.NDJSON = finishAlongsideNDJSON(nd)
 	}
-	return added, nil
+	return nil
 }
 
-// verifyZipContainsAll checks that each path in added exists in the zip and uncompressed size matches
-func verifyZipContainsAll(zipPath string, added []string) map[string]bool {
+// verifyZipContainsAll checks that each manifest entry exists in the zip with the size that was written.
+// Without redaction the entry must also still match the size of the source file; with redaction it must
+// hold every line of the source, so a file of unknown format is never deleted after its lines were dropped.
+func verifyZipContainsAll(zipPath string, added []ManifestEntry) map[string]bool {
 	result := make(map[string]bool, len(added))
 	zr, err := zip.OpenReader(zipPath)
 	if err != nil {
-		for _, p := range added {
-			result[p] = false
+		for _, e := range added {
+			result[e.SourcePath] = false
 		}
-		stats.Errors = append(stats.Errors, fmt.Sprintf("verify open zip %s: %v", zipPath, err))
+		addError("verify_failed", "", zipPath, fmt.Sprintf("verify open zip %s: %v", zipPath, err))
 		return result
 	}
 	defer zr.Close()
 
-	// Build map of entry name to uncompressed size
-	entries := make(map[string]uint64, len(zr.File))
-	for _, f := range zr.File {
-		entries[f.Name] = f.UncompressedSize64
-	}
-	for _, p := range added {
-		base := filepath.Base(p)
-		stat, err := os.Stat(p)
-		if err != nil {
-			result[p] = false
+	for _, e := range added {
+		result[e.SourcePath] = false
+		if e.Index >= len(zr.File) {
 			continue
 		}
-		size := stat.Size()
-		if u, ok := entries[base]; ok && int64(u) == size {
-			result[p] = true
-		} else {
-			result[p] = false
+		f := zr.File[e.Index]
+		if f.Name != e.Name || int64(f.UncompressedSize64) != e.StoredSize || e.DroppedLines > 0 {
+			continue
+		}
+		if redaction == nil {
+			stat, err := os.Stat(e.SourcePath)
+			if err != nil || stat.Size() != e.StoredSize {
+				continue
+			}
 		}
+		result[e.SourcePath] = true
 	}
 	return result
 }
@@ -502,14 +932,13 @@ func compressLogFile(logFile LogFile) error {
 	stats.TotalSizeAfter += compressedSize
 	mu.Unlock()
 
-	fmt.Printf("Compressed: %s -> %s (%.2f%% reduction)\n",
-		logFile.Path, destPath,
-		float64(logFile.Size-compressedSize)/float64(logFile.Size)*100)
+	logger.Info("file compressed", "source", logFile.Path, "archive", destPath,
+		"reduction_percent", float64(logFile.Size-compressedSize)/float64(logFile.Size)*100)
 
 	// Remove original file after successful compression (per-file mode)
 	if config.DeleteOriginalAfterCompress {
 		if err := os.Remove(logFile.Path); err != nil {
-			fmt.Printf("Warning: Failed to remove original file %s: %v\n", logFile.Path, err)
+			addWarning("delete_failed", logFile.Path, "Failed to remove original file %s: %v", logFile.Path, err)
 		}
 	}
 
@@ -615,7 +1044,9 @@ func getCompressionExtension() string {
 	}
 }
 
-func cleanupOldCompressedLogs() error {
+// cleanupOldCompressedLogs applies keep_last_n_archives or retention_days to dest_folder, stopping with
+// ctx.Err() when ctx is cancelled
+func cleanupOldCompressedLogs(ctx context.Context) error {
 	// Option A: Keep last N archives if set
 	if config.KeepLastNArchives > 0 {
 		entries, err := os.ReadDir(config.DestFolder)
@@ -643,9 +1074,11 @@ func cleanupOldCompressedLogs() error {
 		}
 		sort.Slice(files, func(i, j int) bool { return files[i].mod.After(files[j].mod) })
 		for idx, f := range files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if idx >= config.KeepLastNArchives {
-				fmt.Printf("Removing old compressed log (keep last %d): %s\n", config.KeepLastNArchives, f.path)
-				_ = os.Remove(f.path)
+				recordRetention(f.path, "keep_last_n_archives", removeArchive(f.path))
 			}
 		}
 		return nil
@@ -660,21 +1093,43 @@ func cleanupOldCompressedLogs() error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
 		if info.ModTime().Before(cutoffDate) {
-			fmt.Printf("Removing old compressed log: %s\n", path)
-			return os.Remove(path)
+			err := os.Remove(path)
+			recordRetention(path, "retention_days", err)
+			return err
 		}
 		return nil
 	})
 }
 
+// logRunFinished logs the outcome of the run as one event, at warn or error level when it did not succeed
+func logRunFinished() {
+	status := runStatus()
+	level := slog.LevelInfo
+	switch status {
+	case "failed":
+		level = slog.LevelError
+	case "warnings", "cancelled":
+		level = slog.LevelWarn
+	}
+	logger.Log(context.Background(), level, "run finished", "status", status, "groups", stats.GroupCount,
+		"files_processed", stats.FilesProcessed, "files_compressed", stats.FilesCompressed,
+		"bytes_before", stats.TotalSizeBefore, "bytes_after", stats.TotalSizeAfter,
+		"errors", len(stats.Errors), "warnings", len(stats.Warnings),
+		"duration_seconds", stats.EndTime.Sub(stats.StartTime).Seconds())
+}
+
 func printSummary() {
 	fmt.Println("\n" + strings.Repeat("=", 50))
 	fmt.Println("COMPRESSION SUMMARY")
 	fmt.Println(strings.Repeat("=", 50))
+	fmt.Printf("Status: %s\n", statusLabel(runStatus()))
 	fmt.Printf("Files processed: %d\n", stats.FilesProcessed)
 	fmt.Printf("Files compressed: %d\n", stats.FilesCompressed)
 	fmt.Printf("Total size before: %.2f MB\n", float64(stats.TotalSizeBefore)/(1024*1024))
@@ -686,6 +1141,15 @@ func printSummary() {
 	}
 
 	fmt.Printf("Processing time: %v\n", stats.EndTime.Sub(stats.StartTime))
+	if len(stats.Uploads) > 0 {
+		failed := 0
+		for _, u := range stats.Uploads {
+			if u.Err != "" {
+				failed++
+			}
+		}
+		fmt.Printf("Uploads: %d succeeded, %d failed\n", len(stats.Uploads)-failed, failed)
+	}
 
 	if len(stats.Errors) > 0 {
 		fmt.Printf("Errors encountered: %d\n", len(stats.Errors))
@@ -698,91 +1162,18 @@ func printSummary() {
 			fmt.Printf("  ... and %d more errors\n", len(stats.Errors)-5)
 		}
 	}
-	fmt.Println(strings.Repeat("=", 50))
-}
-
-// sendEmailNotification includes tool branding in subject
-func sendEmailNotification() error {
-	// Determine status
-	status := "Success"
-	if len(stats.Errors) > 0 {
-		status = "Failed"
-	}
-
-	// Hostname
-	host, _ := os.Hostname()
-	if host == "" {
-		host = "unknown-host"
-	}
-
-	// Subject: e.g., "Success - IIS backup myhost.domain"
-	subject := fmt.Sprintf("%s - IIS backup %s", status, host)
-	if s := strings.TrimSpace(config.EmailNotification.Subject); s != "" {
-		// If user provided a custom subject, still prefix with status + IIS backup + host
-		subject = fmt.Sprintf("%s - IIS backup %s - %s", status, host, s)
-	}
-
-	// HTML body
-	elapsed := stats.EndTime.Sub(stats.StartTime)
-	reduction := 0.0
-	if stats.TotalSizeBefore > 0 {
-		reduction = float64(stats.TotalSizeBefore-stats.TotalSizeAfter) / float64(stats.TotalSizeBefore) * 100
-	}
-	body := strings.Builder{}
-	body.WriteString("<html><body>")
-	body.WriteString(fmt.Sprintf("<h3>%s</h3>", subject))
-	body.WriteString("<table border=\"1\" cellpadding=\"6\" cellspacing=\"0\">")
-	body.WriteString(fmt.Sprintf("<tr><td>Groups (months)</td><td>%d</td></tr>", stats.GroupCount))
-	body.WriteString(fmt.Sprintf("<tr><td>Files processed</td><td>%d</td></tr>", stats.FilesProcessed))
-	body.WriteString(fmt.Sprintf("<tr><td>Files compressed</td><td>%d</td></tr>", stats.FilesCompressed))
-	body.WriteString(fmt.Sprintf("<tr><td>Total before</td><td>%.2f MB</td></tr>", float64(stats.TotalSizeBefore)/(1024*1024)))
-	body.WriteString(fmt.Sprintf("<tr><td>Total after</td><td>%.2f MB</td></tr>", float64(stats.TotalSizeAfter)/(1024*1024)))
-	body.WriteString(fmt.Sprintf("<tr><td>Compression ratio</td><td>%.2f%%</td></tr>", reduction))
-	body.WriteString(fmt.Sprintf("<tr><td>Start</td><td>%s</td></tr>", stats.StartTime.Format(time.RFC3339)))
-	body.WriteString(fmt.Sprintf("<tr><td>End</td><td>%s</td></tr>", stats.EndTime.Format(time.RFC3339)))
-	body.WriteString(fmt.Sprintf("<tr><td>Duration</td><td>%v</td></tr>", elapsed))
-	body.WriteString(fmt.Sprintf("<tr><td>CPU Count</td><td>%d</td></tr>", runtime.NumCPU()))
-	body.WriteString(fmt.Sprintf("<tr><td>GOMAXPROCS</td><td>%d</td></tr>", runtime.GOMAXPROCS(0)))
-	if len(stats.Errors) > 0 {
-		body.WriteString("<tr><td>Errors</td><td><ul>")
-		for _, e := range stats.Errors {
-			body.WriteString("<li>")
-			body.WriteString(htmlEscape(e))
-			body.WriteString("</li>")
+	if len(stats.Warnings) > 0 {
+		fmt.Printf("Warnings: %d\n", len(stats.Warnings))
+		for i, w := range stats.Warnings {
+			if i < 5 {
+				fmt.Printf("  - %s\n", w)
+			}
 		}
-		body.WriteString("</ul></td></tr>")
-	}
-	body.WriteString("</table>")
-	body.WriteString(fmt.Sprintf("<p><small>%s</small></p>", htmlEscape(toolName)))
-	body.WriteString("</body></html>")
-
-	addr := fmt.Sprintf("%s:%d", config.EmailNotification.SMTPHost, config.EmailNotification.SMTPPort)
-	auth := smtp.PlainAuth("", config.EmailNotification.Username, config.EmailNotification.Password, config.EmailNotification.SMTPHost)
-
-	// Build MIME message for HTML
-	msg := strings.Builder{}
-	msg.WriteString(fmt.Sprintf("From: %s\r\n", config.EmailNotification.From))
-	msg.WriteString(fmt.Sprintf("To: %s\r\n", config.EmailNotification.To))
-	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	msg.WriteString("MIME-Version: 1.0\r\n")
-	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
-	msg.WriteString(body.String())
-
-	if err := smtp.SendMail(addr, auth, config.EmailNotification.From, []string{config.EmailNotification.To}, []byte(msg.String())); err != nil {
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
-			return fmt.Errorf("smtp timeout: %v", err)
+		if len(stats.Warnings) > 5 {
+			fmt.Printf("  ... and %d more warnings\n", len(stats.Warnings)-5)
 		}
-		return err
 	}
-	return nil
-}
-
-// htmlEscape is a minimal escaper for text in HTML context
-func htmlEscape(s string) string {
-	r := strings.ReplaceAll(s, "&", "&amp;")
-	r = strings.ReplaceAll(r, "<", "&lt;")
-	r = strings.ReplaceAll(r, ">", "&gt;")
-	return r
+	fmt.Println(strings.Repeat("=", 50))
 }
 
 // writeRunReport saves a detailed text report next to the executable
@@ -791,11 +1182,16 @@ func writeRunReport() error {
 	if err != nil {
 		return err
 	}
-	name := fmt.Sprintf("compression_report_%s.txt", time.Now().Format("YYYYMMDD_HHmmss"))
-	// fix Go time format
-	name = fmt.Sprintf("compression_report_%s.txt", time.Now().Format("20060102_150405"))
-	path := filepath.Join(exeDir, name)
+	return os.WriteFile(filepath.Join(exeDir, runReportName()), []byte(runReportText()), 0644)
+}
+
+// runReportName is the file name of the run report, e.g. compression_report_20240501_020000.txt
+func runReportName() string {
+	return fmt.Sprintf("compression_report_%s.txt", stats.EndTime.Format("20060102_150405"))
+}
 
+// runReportText renders the run report; the email status is left out until the email was sent
+func runReportText() string {
 	elapsed := stats.EndTime.Sub(stats.StartTime)
 	throughputMBs := 0.0
 	if elapsed > 0 && stats.TotalSizeBefore > 0 {
@@ -808,6 +1204,7 @@ func writeRunReport() error {
 	b.WriteString(fmt.Sprintf("Start: %s\n", stats.StartTime.Format(time.RFC3339)))
 	b.WriteString(fmt.Sprintf("End:   %s\n", stats.EndTime.Format(time.RFC3339)))
 	b.WriteString(fmt.Sprintf("Duration: %v\n", elapsed))
+	b.WriteString(fmt.Sprintf("Status: %s\n", statusLabel(runStatus())))
 	b.WriteString(fmt.Sprintf("CPU Count: %d\n", runtime.NumCPU()))
 	b.WriteString(fmt.Sprintf("GOMAXPROCS: %d\n", runtime.GOMAXPROCS(0)))
 	b.WriteString(fmt.Sprintf("Groups (months): %d\n", stats.GroupCount))
@@ -820,7 +1217,37 @@ func writeRunReport() error {
 		b.WriteString(fmt.Sprintf("Compression ratio: %.2f%%\n", reduction))
 	}
 	b.WriteString(fmt.Sprintf("Throughput: %.2f MB/s\n", throughputMBs))
-	b.WriteString(fmt.Sprintf("Email status: %s\n", stats.EmailStatus))
+	if stats.Traffic != nil {
+		ts := stats.Traffic.Summary()
+		b.WriteString("Traffic:\n")
+		b.WriteString(fmt.Sprintf("  Requests: %d (malformed lines: %d)\n", ts.Requests, ts.MalformedLines))
+		if !ts.FirstRequest.IsZero() {
+			b.WriteString(fmt.Sprintf("  Period: %s - %s\n", ts.FirstRequest.Format(time.RFC3339), ts.LastRequest.Format(time.RFC3339)))
+		}
+		b.WriteString(fmt.Sprintf("  Status codes: %s\n", ts.StatusClasses()))
+		b.WriteString(fmt.Sprintf("  Bytes sent: %.2f MB, received: %.2f MB\n", float64(ts.BytesSent)/(1024*1024), float64(ts.BytesReceived)/(1024*1024)))
+		b.WriteString(fmt.Sprintf("  Time taken p50/p95/p99: %d / %d / %d ms\n", ts.TimeTakenP50Ms, ts.TimeTakenP95Ms, ts.TimeTakenP99Ms))
+		b.WriteString(fmt.Sprintf("  Top URIs: %s\n", formatTop(ts.TopURIs, 5)))
+		b.WriteString(fmt.Sprintf("  Top client IPs: %s\n", formatTop(ts.TopClientIPs, 5)))
+	}
+	if len(stats.Uploads) > 0 {
+		b.WriteString("Uploads:\n")
+		for _, u := range stats.Uploads {
+			if u.Err != "" {
+				b.WriteString(fmt.Sprintf("  FAILED %s -> %s (%s): %s\n", u.File, u.Location, u.Target, u.Err))
+			} else {
+				b.WriteString(fmt.Sprintf("  OK %s -> %s (%.2f MB in %v)\n", u.File, u.Location, float64(u.Size)/(1024*1024), u.Duration.Round(time.Millisecond)))
+			}
+		}
+	}
+	if stats.EmailStatus != "" {
+		b.WriteString(fmt.Sprintf("Email status: %s\n", stats.EmailStatus))
+	}
+	for _, n := range stats.Notifications {
+		if n.Channel == "webhook" {
+			b.WriteString(strings.TrimSpace(fmt.Sprintf("Webhook status: %s: %s %s", n.Name, n.Status, n.Detail)) + "\n")
+		}
+	}
 	if len(stats.Errors) > 0 {
 		b.WriteString("Errors:\n")
 		for _, e := range stats.Errors {
@@ -829,9 +1256,17 @@ func writeRunReport() error {
 			b.WriteString("\n")
 		}
 	}
+	if len(stats.Warnings) > 0 {
+		b.WriteString("Warnings:\n")
+		for _, w := range stats.Warnings {
+			b.WriteString(" - ")
+			b.WriteString(w)
+			b.WriteString("\n")
+		}
+	}
 	b.WriteString("\nOpen-source: Free to use. Do whatever you want with it.\n")
 	b.WriteString("Maker: Nader Barakat (www.naderb.org)\n")
-	return os.WriteFile(path, []byte(b.String()), 0644)
+	return b.String()
 }
 
 // deleteWithRetry attempts to remove a file multiple times
@@ -847,3 +1282,40 @@ func deleteWithRetry(path string, attempts int, delay time.Duration) error {
 	}
 	return lastErr
 }
+
+// sleepContext waits for d or until ctx is cancelled, returning ctx.Err() in that case
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// contextReader fails with ctx.Err() once ctx is cancelled, so long copies stop between reads
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
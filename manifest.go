@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestExtension = ".manifest.json"
+
+// Manifest describes the contents of an archive and is stored next to it
+type Manifest struct {
+	Archive   string            `json:"archive"`
+	Group     string            `json:"group"`
+	Scope     string            `json:"scope"`
+	Host      string            `json:"host"`
+	CreatedAt time.Time         `json:"created_at"`
+	Entries   []ManifestEntry   `json:"entries"`
+	Traffic   *TrafficSummary   `json:"traffic,omitempty"`
+	Redaction *RedactionProfile `json:"redaction,omitempty"`
+	Parquet   []string          `json:"parquet,omitempty"`
+	NDJSON    string            `json:"ndjson,omitempty"`
+}
+
+// ManifestEntry describes a single log file stored in an archive
+type ManifestEntry struct {
+	Index        int       `json:"index"`
+	Name         string    `json:"name"`
+	SourcePath   string    `json:"source_path"`
+	Site         string    `json:"site,omitempty"`
+	Format       string    `json:"format"`
+	Size         int64     `json:"size"`
+	StoredSize   int64     `json:"stored_size"`
+	DroppedLines int64     `json:"dropped_lines,omitempty"` // unparseable lines left out by redaction
+	ModTime      time.Time `json:"mod_time"`
+}
+
+// newManifest starts a manifest for the archive of a group
+func newManifest(archivePath, groupKey string) *Manifest {
+	host, _ := os.Hostname()
+	return &Manifest{
+		Archive:   filepath.Base(archivePath),
+		Group:     groupKey,
+		Scope:     strings.ToLower(config.ArchiveScope),
+		Host:      host,
+		CreatedAt: time.Now(),
+		Entries:   make([]ManifestEntry, 0),
+	}
+}
+
+// writeManifest stores the manifest as "<archive>.manifest.json"
+func writeManifest(archivePath string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest for %s: %v", archivePath, err)
+	}
+	if err := os.WriteFile(archivePath+manifestExtension, data, 0644); err != nil {
+		return fmt.Errorf("write manifest for %s: %v", archivePath, err)
+	}
+	return nil
+}
+
+// readManifest loads the manifest stored next to an archive
+func readManifest(archivePath string) (*Manifest, error) {
+	data, err := os.ReadFile(archivePath + manifestExtension)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest for %s: %v", archivePath, err)
+	}
+	return &m, nil
+}
+
+// siteForPath returns the IIS site folder (e.g. W3SVC2) a log file lives in, or "" for the source root
+func siteForPath(path string) string {
+	dir := filepath.Dir(path)
+	if filepath.Clean(dir) == filepath.Clean(config.SourceFolder) {
+		return ""
+	}
+	return filepath.Base(dir)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PhaseTiming is the wall-clock duration of one phase of a run
+type PhaseTiming struct {
+	Phase   string  `json:"phase"` // discovery, compress, retention, remote_retention, post_run_hook, notifications
+	Seconds float64 `json:"seconds"`
+}
+
+// recordPhase adds the duration of a phase that started at start
+func recordPhase(phase string, start time.Time) {
+	mu.Lock()
+	stats.Phases = append(stats.Phases, PhaseTiming{Phase: phase, Seconds: time.Since(start).Seconds()})
+	mu.Unlock()
+}
+
+// validateMetricsConfig checks metrics_file; the textfile collector only reads files ending in .prom
+func validateMetricsConfig() error {
+	if config.MetricsFile != "" && !strings.HasSuffix(config.MetricsFile, ".prom") {
+		return fmt.Errorf("metrics_file must end in .prom, got %q", config.MetricsFile)
+	}
+	return nil
+}
+
+// promWriter builds a Prometheus text exposition. prev holds the samples of the previous file so that
+// counters keep increasing across runs.
+type promWriter struct {
+	b    strings.Builder
+	prev map[string]float64
+}
+
+// promLabel formats a single-label set such as {code="upload_failed"}
+func promLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`{%s="%s"}`, name, value)
+}
+
+func (w *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *promWriter) sample(name, labels string, v float64) {
+	fmt.Fprintf(&w.b, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// gauge writes a gauge with a single unlabelled sample
+func (w *promWriter) gauge(name, help string, v float64) {
+	w.header(name, "gauge", help)
+	w.sample(name, "", v)
+}
+
+// gaugeVec writes a gauge whose samples are keyed by their label set
+func (w *promWriter) gaugeVec(name, help string, values map[string]float64) {
+	w.header(name, "gauge", help)
+	for _, labels := range sortedKeys(values) {
+		w.sample(name, labels, values[labels])
+	}
+}
+
+// counter writes a counter: the previous value of every series plus this run's increment. Series seen in an
+// earlier run are kept even when they did not change.
+func (w *promWriter) counter(name, help string, inc map[string]float64) {
+	totals := make(map[string]float64)
+	for series, v := range w.prev {
+		if series == name {
+			totals[""] = v
+		} else if strings.HasPrefix(series, name+"{") {
+			totals[strings.TrimPrefix(series, name)] = v
+		}
+	}
+	for labels, v := range inc {
+		totals[labels] += v
+	}
+	w.header(name, "counter", help)
+	for _, labels := range sortedKeys(totals) {
+		w.sample(name, labels, totals[labels])
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readPromSamples reads the samples of an existing .prom file keyed by series name and labels.
+// A missing or unreadable file simply starts the counters from zero.
+func readPromSamples(path string) map[string]float64 {
+	samples := make(map[string]float64)
+	f, err := os.Open(path)
+	if err != nil {
+		return samples
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+// writeMetricsFile writes the run metrics to metrics_file for the node_exporter / windows_exporter textfile
+// collector. The file is replaced atomically so the collector never reads a partial file.
+func writeMetricsFile() error {
+	if config.MetricsFile == "" {
+		return nil
+	}
+	path := config.MetricsFile
+	w := &promWriter{prev: readPromSamples(path)}
+	status := runStatus()
+	end := float64(stats.EndTime.UnixNano()) / 1e9
+
+	w.gauge("iislc_last_run_timestamp_seconds", "End time of the last run.", end)
+	succeeded := status == "success" || status == "warnings"
+	lastSuccess := w.prev["iislc_last_success_timestamp_seconds"]
+	if succeeded {
+		lastSuccess = end
+	}
+	w.gauge("iislc_last_success_timestamp_seconds", "End time of the last run that neither failed nor was cancelled.", lastSuccess)
+	success := 0.0
+	if succeeded {
+		success = 1
+	}
+	w.gauge("iislc_last_run_success", "1 if the last run succeeded (possibly with warnings), 0 if it failed or was cancelled.", success)
+	statuses := make(map[string]float64)
+	for _, s := range []string{"success", "warnings", "failed", "cancelled"} {
+		statuses[promLabel("status", s)] = 0
+	}
+	statuses[promLabel("status", status)] = 1
+	w.gaugeVec("iislc_last_run_status", "Status of the last run.", statuses)
+	w.gauge("iislc_last_run_duration_seconds", "Duration of the last run.", stats.EndTime.Sub(stats.StartTime).Seconds())
+	phases := make(map[string]float64)
+	for _, p := range stats.Phases {
+		phases[promLabel("phase", p.Phase)] += p.Seconds
+	}
+	w.gaugeVec("iislc_last_run_phase_duration_seconds", "Duration of each phase of the last run.", phases)
+	w.gauge("iislc_last_run_groups", "Groups (months or days) processed by the last run.", float64(stats.GroupCount))
+	written := 0
+	for _, g := range stats.Groups {
+		if g.Error == "" && g.Files > 0 {
+			written++
+		}
+	}
+	w.gauge("iislc_last_run_archives_written", "Archives written by the last run.", float64(written))
+	w.gauge("iislc_last_run_files_compressed", "Log files compressed by the last run.", float64(stats.FilesCompressed))
+	w.gauge("iislc_last_run_bytes_in", "Size of the log files compressed by the last run.", float64(stats.TotalSizeBefore))
+	w.gauge("iislc_last_run_bytes_out", "Size of the archives written by the last run.", float64(stats.TotalSizeAfter))
+
+	errs := make(map[string]float64)
+	warns := make(map[string]float64)
+	for _, is := range stats.Issues {
+		if is.Level == "error" {
+			errs[promLabel("code", is.Code)]++
+		} else {
+			warns[promLabel("code", is.Code)]++
+		}
+	}
+	w.gaugeVec("iislc_last_run_errors", "Errors of the last run by code.", errs)
+	w.gaugeVec("iislc_last_run_warnings", "Warnings of the last run by code.", warns)
+
+	if count, size, err := destArchives(); err == nil {
+		w.gauge("iislc_archives", "Archives in dest_folder.", float64(count))
+		w.gauge("iislc_archive_bytes", "Total size of the archives in dest_folder.", float64(size))
+	}
+	if free, total, err := diskSpace(config.DestFolder); err == nil {
+		w.gauge("iislc_dest_free_bytes", "Free space available on the dest_folder volume.", float64(free))
+		w.gauge("iislc_dest_size_bytes", "Size of the dest_folder volume.", float64(total))
+	}
+
+	w.counter("iislc_runs_total", "Runs by status.", map[string]float64{promLabel("status", status): 1})
+	w.counter("iislc_files_compressed_total", "Log files compressed.", map[string]float64{"": float64(stats.FilesCompressed)})
+	w.counter("iislc_bytes_in_total", "Size of the log files compressed.", map[string]float64{"": float64(stats.TotalSizeBefore)})
+	w.counter("iislc_bytes_out_total", "Size of the archives written.", map[string]float64{"": float64(stats.TotalSizeAfter)})
+	w.counter("iislc_errors_total", "Errors by code.", errs)
+	w.counter("iislc_warnings_total", "Warnings by code.", warns)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(w.b.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// destArchives counts the archives directly in dest_folder and their total size. Subfolders and NDJSON
+// exports are skipped, so the parquet and ndjson export folders are not counted.
+func destArchives() (int, int64, error) {
+	entries, err := os.ReadDir(config.DestFolder)
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	var size int64
+	for _, e := range entries {
+		if e.IsDir() || !isArchiveFile(e.Name()) || isNDJSONFile(e.Name()) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			count++
+			size += info.Size()
+		}
+	}
+	return count, size, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPromLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"upload_failed", `{code="upload_failed"}`},
+		{`C:\logs`, `{code="C:\\logs"}`},
+		{`say "hi"`, `{code="say \"hi\""}`},
+		{"two\nlines", `{code="two\nlines"}`},
+	}
+	for _, tt := range tests {
+		if got := promLabel("code", tt.value); got != tt.want {
+			t.Errorf("promLabel(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDestArchives(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]int{
+		"logs_2024-05.zip":                     100,
+		"logs_2024-04.tar.zst":                 50,
+		"logs_2024-05.zip.sha256":              64,
+		"export_2024-05.ndjson.gz":             1000,
+		"ndjson/export_2024-04.ndjson.gz":      1000,
+		"parquet/site=W3SVC1/date=x/a.parquet": 1000,
+		"old/logs_2023-01.zip":                 1000,
+	}
+	for name, size := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := config.DestFolder
+	defer func() { config.DestFolder = saved }()
+	config.DestFolder = dir
+
+	count, size, err := destArchives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || size != 150 {
+		t.Errorf("destArchives = %d archives, %d bytes; want 2 archives, 150 bytes", count, size)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"iis-log-compressor/iislog"
+)
+
+// NDJSONConfig controls the newline-delimited JSON copy of the records written next to each archive
+type NDJSONConfig struct {
+	Mode        string `json:"mode"`        // "" (off) or "alongside"
+	Compression string `json:"compression"` // "gzip" (default) or "zstd"
+	Folder      string `json:"folder"`      // defaults to <dest_folder>/ndjson
+}
+
+// ndjsonRecord is the JSON form of a log record; field names match the Parquet columns.
+// Numeric fields that are absent or null in the log are omitted.
+type ndjsonRecord struct {
+	Timestamp     string `json:"timestamp,omitempty"`
+	Site          string `json:"site,omitempty"`
+	Archive       string `json:"archive,omitempty"`
+	LogFile       string `json:"log_file,omitempty"`
+	LogFormat     string `json:"log_format"`
+	SiteName      string `json:"s_sitename,omitempty"`
+	ComputerName  string `json:"s_computername,omitempty"`
+	ServerIP      string `json:"s_ip,omitempty"`
+	Method        string `json:"cs_method,omitempty"`
+	URIStem       string `json:"cs_uri_stem,omitempty"`
+	URIQuery      string `json:"cs_uri_query,omitempty"`
+	ServerPort    *int32 `json:"s_port,omitempty"`
+	Username      string `json:"cs_username,omitempty"`
+	ClientIP      string `json:"c_ip,omitempty"`
+	Version       string `json:"cs_version,omitempty"`
+	UserAgent     string `json:"cs_user_agent,omitempty"`
+	Referer       string `json:"cs_referer,omitempty"`
+	Host          string `json:"cs_host,omitempty"`
+	Status        *int32 `json:"sc_status,omitempty"`
+	SubStatus     *int32 `json:"sc_substatus,omitempty"`
+	Win32Status   *int64 `json:"sc_win32_status,omitempty"`
+	BytesSent     *int64 `json:"sc_bytes,omitempty"`
+	BytesReceived *int64 `json:"cs_bytes,omitempty"`
+	TimeTakenMs   *int64 `json:"time_taken_ms,omitempty"`
+}
+
+// ndjsonWriter encodes records as one JSON object per line into an optionally compressed stream
+type ndjsonWriter struct {
+	path    string // final file name; "" when writing to a stream owned by the caller
+	file    *os.File
+	comp    io.WriteCloser // nil when uncompressed
+	bw      *bufio.Writer
+	enc     *json.Encoder
+	site    string
+	archive string
+	logFile string
+	count   int64
+	err     error
+}
+
+// validateNDJSONConfig normalises the ndjson settings
+func validateNDJSONConfig(nc *NDJSONConfig) error {
+	nc.Mode = strings.ToLower(strings.TrimSpace(nc.Mode))
+	switch nc.Mode {
+	case "", "alongside":
+	default:
+		return fmt.Errorf("ndjson.mode must be \"alongside\", got %q", nc.Mode)
+	}
+	nc.Compression = strings.ToLower(strings.TrimSpace(nc.Compression))
+	switch nc.Compression {
+	case "":
+		nc.Compression = "gzip"
+	case "gzip", "zstd":
+	default:
+		return fmt.Errorf("ndjson.compression must be \"gzip\" or \"zstd\", got %q", nc.Compression)
+	}
+	if nc.Folder == "" {
+		nc.Folder = filepath.Join(config.DestFolder, "ndjson")
+	}
+	return nil
+}
+
+// ndjsonExtension returns the file extension for a compression ("gzip", "zstd" or "none")
+func ndjsonExtension(compression string) string {
+	switch compression {
+	case "gzip":
+		return ".ndjson.gz"
+	case "zstd":
+		return ".ndjson.zst"
+	}
+	return ".ndjson"
+}
+
+// isNDJSONFile reports whether a file in dest_folder is an NDJSON export rather than a log archive
+func isNDJSONFile(name string) bool {
+	return strings.Contains(strings.ToLower(filepath.Base(name)), ".ndjson")
+}
+
+// newNDJSONWriter writes records to w, compressed with "gzip", "zstd" or not at all ("none")
+func newNDJSONWriter(w io.Writer, compression string) (*ndjsonWriter, error) {
+	nw := &ndjsonWriter{}
+	switch compression {
+	case "gzip":
+		nw.comp = gzip.NewWriter(w)
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		nw.comp = zw
+	case "none", "":
+	default:
+		return nil, fmt.Errorf("unsupported ndjson compression %q (supported: none, gzip, zstd)", compression)
+	}
+	if nw.comp != nil {
+		w = nw.comp
+	}
+	nw.bw = bufio.NewWriterSize(w, 256*1024)
+	nw.enc = json.NewEncoder(nw.bw)
+	nw.enc.SetEscapeHTML(false)
+	return nw, nil
+}
+
+// createNDJSONFile writes records to path; the file is written under a temporary name and moved into place by Close
+func createNDJSONFile(path, compression string) (*ndjsonWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	nw, err := newNDJSONWriter(f, compression)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path + ".tmp")
+		return nil, err
+	}
+	nw.path = path
+	nw.file = f
+	return nw, nil
+}
+
+// setSource sets the archive, log file and site reported with the records that follow
+func (w *ndjsonWriter) setSource(archive, logFile, site string) {
+	w.archive = archive
+	w.logFile = logFile
+	w.site = site
+}
+
+// Add encodes a single record; errors are reported by Close
+func (w *ndjsonWriter) Add(rec *iislog.Record) {
+	if w.err != nil {
+		return
+	}
+	row := newParquetRow(rec)
+	out := ndjsonRecord{
+		Site:          w.site,
+		Archive:       w.archive,
+		LogFile:       w.logFile,
+		LogFormat:     rec.Format().String(),
+		SiteName:      row.SiteName,
+		ComputerName:  row.ComputerName,
+		ServerIP:      row.ServerIP,
+		Method:        row.Method,
+		URIStem:       row.URIStem,
+		URIQuery:      row.URIQuery,
+		ServerPort:    row.ServerPort,
+		Username:      row.Username,
+		ClientIP:      row.ClientIP,
+		Version:       row.Version,
+		UserAgent:     row.UserAgent,
+		Referer:       row.Referer,
+		Host:          row.Host,
+		Status:        row.Status,
+		SubStatus:     row.SubStatus,
+		Win32Status:   row.Win32Status,
+		BytesSent:     row.BytesSent,
+		BytesReceived: row.BytesReceived,
+		TimeTakenMs:   row.TimeTakenMs,
+	}
+	if !rec.Time.IsZero() {
+		out.Timestamp = rec.Time.UTC().Format(time.RFC3339)
+	}
+	if err := w.enc.Encode(&out); err != nil {
+		w.err = err
+		return
+	}
+	w.count++
+}
+
+// Close flushes the stream. For files created by createNDJSONFile the file is moved into place,
+// or removed when anything failed.
+func (w *ndjsonWriter) Close() error {
+	err := w.err
+	if ferr := w.bw.Flush(); ferr != nil && err == nil {
+		err = ferr
+	}
+	if w.comp != nil {
+		if cerr := w.comp.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if w.file == nil {
+		return err
+	}
+	if cerr := w.file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(w.path + ".tmp")
+		return fmt.Errorf("write %s: %v", w.path, err)
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
+
+// abort closes the stream and removes the file created by createNDJSONFile
+func (w *ndjsonWriter) abort() {
+	if w.err == nil {
+		w.err = context.Canceled
+	}
+	_ = w.Close()
+}
+
+// createAlongsideNDJSON starts the NDJSON copy of a group when ndjson.mode is "alongside", or returns nil.
+// Failures are recorded in the run errors; the archive itself is still written.
+func createAlongsideNDJSON(name string) *ndjsonWriter {
+	if config.NDJSON.Mode != "alongside" {
+		return nil
+	}
+	path := filepath.Join(config.NDJSON.Folder, name+ndjsonExtension(config.NDJSON.Compression))
+	nw, err := createNDJSONFile(path, config.NDJSON.Compression)
+	if err != nil {
+		addError("ndjson_failed", "", path, fmt.Sprintf("ndjson %s: %v", path, err))
+		return nil
+	}
+	return nw
+}
+
+// finishAlongsideNDJSON closes the NDJSON copy of a group, writes its checksum sidecar and returns
+// its path relative to the ndjson folder, or "" when it could not be written
+func finishAlongsideNDJSON(nw *ndjsonWriter) string {
+	err := nw.Close()
+	if err == nil {
+		err = writeChecksumSidecar(nw.path)
+	}
+	if err != nil {
+		addError("ndjson_failed", "", nw.path, fmt.Sprintf("ndjson: %v", err))
+		return ""
+	}
+	logger.Info("ndjson written", "path", nw.path, "records", nw.count)
+	if rel, err := filepath.Rel(config.NDJSON.Folder, nw.path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return nw.path
+}
+
+// runExport implements the export subcommand: records of the archives in dest_folder are written as NDJSON
+// to stdout or a file. Progress goes to stderr so stdout can be piped into a log shipper.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	site := fs.String("site", "", "only export logs of this site folder (e.g. W3SVC2)")
+	fromFlag := fs.String("from", "", "start of the time range in UTC (inclusive)")
+	toFlag := fs.String("to", "", "end of the time range in UTC (exclusive; a date-only value includes that day)")
+	outPath := fs.String("out", "-", "output file, or - for stdout")
+	compression := fs.String("compression", "", "none, gzip or zstd (default: from the -out extension, none for stdout)")
+	_ = fs.Parse(args)
+
+	from := time.Time{}
+	to := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if *fromFlag != "" {
+		t, err := parseTimeFlag(*fromFlag, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: -from: %v\n", err)
+			return exitInvalidConfig
+		}
+		from = t
+	}
+	if *toFlag != "" {
+		t, err := parseTimeFlag(*toFlag, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: -to: %v\n", err)
+			return exitInvalidConfig
+		}
+		to = t
+	}
+	if !from.Before(to) {
+		fmt.Fprintln(os.Stderr, "export: -from must be before -to")
+		return exitInvalidConfig
+	}
+	comp := strings.ToLower(*compression)
+	if comp == "" {
+		switch lower := strings.ToLower(*outPath); {
+		case strings.HasSuffix(lower, ".gz"):
+			comp = "gzip"
+		case strings.HasSuffix(lower, ".zst"):
+			comp = "zstd"
+		default:
+			comp = "none"
+		}
+	}
+
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return exitInvalidConfig
+	}
+	archives, err := findArchives(config.DestFolder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to scan %s: %v\n", config.DestFolder, err)
+		return exitFailed
+	}
+
+	var nw *ndjsonWriter
+	if *outPath == "-" {
+		nw, err = newNDJSONWriter(os.Stdout, comp)
+	} else {
+		nw, err = createNDJSONFile(*outPath, comp)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitFailed
+	}
+
+	logFiles, failures := 0, 0
+	for _, archivePath := range archives {
+		// Sites are only known for archives that carry a manifest
+		sites := make(map[int]string)
+		manifest, err := readManifest(archivePath)
+		if err == nil {
+			for _, me := range manifest.Entries {
+				sites[me.Index] = me.Site
+			}
+		} else if *site != "" {
+			fmt.Fprintf(os.Stderr, "Skipping %s: no manifest to tell sites apart\n", archivePath)
+			continue
+		}
+
+		err = forEachArchiveEntry(archivePath, func(e archiveEntry) error {
+			entrySite := sites[e.Index]
+			if *site != "" && !strings.EqualFold(entrySite, *site) {
+				return nil
+			}
+			start, end := logSpan(e.Name, e.ModTime)
+			if !start.Before(to) || !end.After(from) {
+				return nil
+			}
+			rc, err := e.Open()
+			if err != nil {
+				failures++
+				fmt.Fprintf(os.Stderr, "Warning: failed to open %s in %s: %v\n", e.Name, archivePath, err)
+				return nil
+			}
+			defer rc.Close()
+
+			nw.setSource(filepath.Base(archivePath), e.Name, entrySite)
+			lr := iislog.NewReader(rc)
+			for lr.Next() {
+				rec := lr.Record()
+				if rec.Time.IsZero() || rec.Time.Before(from) || !rec.Time.Before(to) {
+					continue
+				}
+				nw.Add(rec)
+			}
+			if err := lr.Err(); err != nil {
+				failures++
+				fmt.Fprintf(os.Stderr, "Warning: failed to read %s in %s: %v\n", e.Name, archivePath, err)
+				return nil
+			}
+			if n := lr.Malformed(); n > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: skipped %d unparseable lines of %s in %s\n", n, e.Name, archivePath)
+			}
+			logFiles++
+			return nil
+		})
+		if err != nil {
+			failures++
+			fmt.Fprintf(os.Stderr, "Warning: failed to read %s: %v\n", archivePath, err)
+		}
+	}
+
+	if err := nw.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records from %d log files", nw.count, logFiles)
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, " (%d failures)\n", failures)
+		return exitFailed
+	}
+	fmt.Fprintln(os.Stderr)
+	return exitSuccess
+}
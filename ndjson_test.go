@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"iis-log-compressor/iislog"
+)
+
+// writeTestNDJSON encodes two W3C records with nw
+func writeTestNDJSON(t *testing.T, nw *ndjsonWriter) {
+	t.Helper()
+	nw.setSource("logs_2024-05-03.zip", "u_ex240503.log", "W3SVC1")
+	lr := iislog.NewReader(strings.NewReader("#Fields: date time c-ip cs-uri-stem sc-status sc-bytes\r\n" +
+		"2024-05-03 10:00:00 10.0.0.5 /a 200 512\r\n" +
+		"2024-05-03 10:00:01 10.0.0.6 /b 404 -\r\n"))
+	for lr.Next() {
+		nw.Add(lr.Record())
+	}
+	if err := lr.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeTestNDJSON decompresses data and decodes one record per line
+func decodeTestNDJSON(t *testing.T, data []byte, compression string) []ndjsonRecord {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(data)
+	switch compression {
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decompress %s: %v", compression, err)
+	}
+	var records []ndjsonRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(plain), "\n"), "\n") {
+		var rec ndjsonRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			nw, err := newNDJSONWriter(&buf, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestNDJSON(t, nw)
+			if err := nw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if nw.count != 2 {
+				t.Errorf("%d records counted, want 2", nw.count)
+			}
+
+			records := decodeTestNDJSON(t, buf.Bytes(), compression)
+			if len(records) != 2 {
+				t.Fatalf("%d records, want 2", len(records))
+			}
+			first := records[0]
+			if first.Timestamp != "2024-05-03T10:00:00Z" || first.ClientIP != "10.0.0.5" || first.URIStem != "/a" ||
+				first.Site != "W3SVC1" || first.Archive != "logs_2024-05-03.zip" || first.LogFile != "u_ex240503.log" {
+				t.Errorf("first record = %+v", first)
+			}
+			if first.Status == nil || *first.Status != 200 || first.BytesSent == nil || *first.BytesSent != 512 {
+				t.Errorf("numeric fields not kept: %+v", first)
+			}
+			if records[1].BytesSent != nil {
+				t.Errorf("sc-bytes \"-\" = %d, want it left out", *records[1].BytesSent)
+			}
+		})
+	}
+
+	if _, err := newNDJSONWriter(io.Discard, "brotli"); err == nil {
+		t.Error("unsupported compression accepted")
+	}
+}
+
+func TestAlongsideNDJSONFile(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.DestFolder = t.TempDir()
+
+	for _, tt := range []struct {
+		compression string
+		want        string
+	}{
+		{"", "logs_2024-05-03.ndjson.gz"},
+		{"zstd", "logs_2024-05-03.ndjson.zst"},
+	} {
+		config.NDJSON = NDJSONConfig{Mode: "alongside", Compression: tt.compression}
+		if err := validateNDJSONConfig(&config.NDJSON); err != nil {
+			t.Fatal(err)
+		}
+		nw := createAlongsideNDJSON("logs_2024-05-03")
+		if nw == nil {
+			t.Fatal("no NDJSON writer for alongside mode")
+		}
+		writeTestNDJSON(t, nw)
+		if rel := finishAlongsideNDJSON(nw); rel != tt.want {
+			t.Errorf("compression %q: written as %q, want %q", tt.compression, rel, tt.want)
+		}
+		path := filepath.Join(config.DestFolder, "ndjson", tt.want)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records := decodeTestNDJSON(t, data, config.NDJSON.Compression); len(records) != 2 {
+			t.Errorf("%s holds %d records, want 2", tt.want, len(records))
+		}
+		if _, err := os.Stat(path + ".sha256"); err != nil {
+			t.Errorf("no checksum sidecar: %v", err)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("temporary file left: %v", err)
+		}
+	}
+
+	config.NDJSON = NDJSONConfig{}
+	if nw := createAlongsideNDJSON("logs_2024-05-03"); nw != nil {
+		t.Error("NDJSON written with ndjson.mode off")
+	}
+}
+
+func TestIsNDJSONFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"logs_2024-05.ndjson.gz", true},
+		{"logs_2024-05.ndjson.zst", true},
+		{"export.NDJSON", true},
+		{"ndjson/logs_2024-05.ndjson.gz", true},
+		{"logs_2024-05.zip", false},
+		{"logs_2024-05.tar.gz", false},
+		{"ndjson/logs_2024-05.tar.zst", false},
+	}
+	for _, tt := range tests {
+		if got := isNDJSONFile(tt.name); got != tt.want {
+			t.Errorf("isNDJSONFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFindArchivesSkipsNDJSON checks that verify, grep, extract and export do not treat NDJSON exports as archives
+func TestFindArchivesSkipsNDJSON(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"logs_2024-05.zip",
+		"logs_2024-04.tar.zst",
+		"logs_2024-05.zip.sha256",
+		filepath.Join("ndjson", "logs_2024-05.ndjson.gz"),
+		filepath.Join("ndjson", "logs_2024-04.ndjson.zst"),
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archives, err := findArchives(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "logs_2024-04.tar.zst"), filepath.Join(root, "logs_2024-05.zip")}
+	if strings.Join(archives, " ") != strings.Join(want, " ") {
+		t.Errorf("archives = %v, want %v", archives, want)
+	}
+}
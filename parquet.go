@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"iis-log-compressor/iislog"
+)
+
+// parquetBatchSize is the number of rows buffered per partition before they are written
+const parquetBatchSize = 4096
+
+// ParquetConfig controls conversion of logs to Parquet files partitioned by site and day
+type ParquetConfig struct {
+	Mode        string `json:"mode"`        // "" (off), "alongside" (next to the zip) or "replace" (no zip)
+	Compression string `json:"compression"` // "snappy" (default) or "zstd"
+	Folder      string `json:"folder"`      // defaults to <dest_folder>/parquet
+}
+
+// parquetRow is the typed Parquet schema of a log record; columns use the W3C names
+type parquetRow struct {
+	Time          int64  `parquet:"time,optional,timestamp(millisecond)"` // null when the record has no date and time
+	SiteName      string `parquet:"s_sitename,optional,dict"`
+	ComputerName  string `parquet:"s_computername,optional,dict"`
+	ServerIP      string `parquet:"s_ip,optional,dict"`
+	Method        string `parquet:"cs_method,optional,dict"`
+	URIStem       string `parquet:"cs_uri_stem,optional,dict"`
+	URIQuery      string `parquet:"cs_uri_query,optional"`
+	ServerPort    *int32 `parquet:"s_port,optional"`
+	Username      string `parquet:"cs_username,optional,dict"`
+	ClientIP      string `parquet:"c_ip,optional,dict"`
+	Version       string `parquet:"cs_version,optional,dict"`
+	UserAgent     string `parquet:"cs_user_agent,optional,dict"`
+	Referer       string `parquet:"cs_referer,optional,dict"`
+	Host          string `parquet:"cs_host,optional,dict"`
+	Status        *int32 `parquet:"sc_status,optional"`
+	SubStatus     *int32 `parquet:"sc_substatus,optional"`
+	Win32Status   *int64 `parquet:"sc_win32_status,optional"`
+	BytesSent     *int64 `parquet:"sc_bytes,optional"`
+	BytesReceived *int64 `parquet:"cs_bytes,optional"`
+	TimeTakenMs   *int64 `parquet:"time_taken_ms,optional"`
+}
+
+// newParquetRow converts a record; the time and numeric fields that are absent or null become null
+func newParquetRow(rec *iislog.Record) parquetRow {
+	int32Field := func(name string, v int) *int32 {
+		if rec.Get(name) == "" {
+			return nil
+		}
+		n := int32(v)
+		return &n
+	}
+	int64Field := func(name string, v int64) *int64 {
+		if rec.Get(name) == "" {
+			return nil
+		}
+		return &v
+	}
+	var ts int64 // optional columns store the zero value as null
+	if !rec.Time.IsZero() {
+		ts = rec.Time.UnixMilli()
+	}
+	return parquetRow{
+		Time:          ts,
+		SiteName:      rec.SiteName,
+		ComputerName:  rec.ComputerName,
+		ServerIP:      rec.ServerIP,
+		Method:        rec.Method,
+		URIStem:       rec.URIStem,
+		URIQuery:      rec.URIQuery,
+		ServerPort:    int32Field(iislog.FieldServerPort, rec.ServerPort),
+		Username:      rec.Username,
+		ClientIP:      rec.ClientIP,
+		Version:       rec.Version,
+		UserAgent:     rec.UserAgent,
+		Referer:       rec.Referer,
+		Host:          rec.Host,
+		Status:        int32Field(iislog.FieldStatus, rec.Status),
+		SubStatus:     int32Field(iislog.FieldSubStatus, rec.SubStatus),
+		Win32Status:   int64Field(iislog.FieldWin32Status, rec.Win32Status),
+		BytesSent:     int64Field(iislog.FieldBytesSent, rec.BytesSent),
+		BytesReceived: int64Field(iislog.FieldBytesReceived, rec.BytesReceived),
+		TimeTakenMs:   int64Field(iislog.FieldTimeTaken, rec.TimeTaken.Milliseconds()),
+	}
+}
+
+// parquetPartition is the Parquet file a single log file writes for a site and day
+type parquetPartition struct {
+	path   string // temporary file of the segment
+	file   *os.File
+	writer *parquet.GenericWriter[parquetRow]
+	rows   []parquetRow
+	count  int64
+}
+
+// parquetSegment is the finished Parquet output of one log file for a site and day
+type parquetSegment struct {
+	path  string
+	count int64
+}
+
+// parquetPartitions writes the records of one group into Parquet files laid out as
+// <folder>/site=<site>/date=<yyyy-mm-dd>/<name>.parquet, which DuckDB and Spark read as hive partitions.
+// Each log file is written to segments of its own, so a file that fails part-way is rolled back without
+// leaving some of its rows behind; Close joins the committed segments of each partition.
+type parquetPartitions struct {
+	folder   string
+	name     string
+	options  []parquet.WriterOption
+	open     map[string]*parquetPartition // segments of the current log file
+	segments map[string][]parquetSegment  // committed segments by partition
+	site     string
+	seq      int
+	err      error // error of the current log file
+}
+
+// validateParquetConfig normalises the parquet settings
+func validateParquetConfig(pc *ParquetConfig) error {
+	pc.Mode = strings.ToLower(strings.TrimSpace(pc.Mode))
+	switch pc.Mode {
+	case "", "alongside", "replace":
+	default:
+		return fmt.Errorf("parquet.mode must be \"alongside\" or \"replace\", got %q", pc.Mode)
+	}
+	pc.Compression = strings.ToLower(strings.TrimSpace(pc.Compression))
+	switch pc.Compression {
+	case "":
+		pc.Compression = "snappy"
+	case "snappy", "zstd":
+	default:
+		return fmt.Errorf("parquet.compression must be \"snappy\" or \"zstd\", got %q", pc.Compression)
+	}
+	if pc.Folder == "" {
+		pc.Folder = filepath.Join(config.DestFolder, "parquet")
+	}
+	if pc.Mode == "replace" && config.PostArchiveCommand.Command != "" {
+		logger.Warn("post_archive_command is not run when parquet.mode is \"replace\": there is no archive")
+	}
+	return nil
+}
+
+// newParquetPartitions starts the Parquet output for a group; name is used as the file name in every partition
+func newParquetPartitions(name string) *parquetPartitions {
+	opts := []parquet.WriterOption{parquet.Compression(&parquet.Snappy)}
+	if config.Parquet.Compression == "zstd" {
+		opts = []parquet.WriterOption{parquet.Compression(&parquet.Zstd)}
+	}
+	return &parquetPartitions{
+		folder:   config.Parquet.Folder,
+		name:     name,
+		options:  opts,
+		open:     make(map[string]*parquetPartition),
+		segments: make(map[string][]parquetSegment),
+	}
+}
+
+// setSite selects the site partition for the records that follow
+func (p *parquetPartitions) setSite(site string) {
+	if site == "" {
+		site = "default"
+	}
+	p.site = site
+}
+
+// Add buffers a record into its site and day partition; errors are reported by commit
+func (p *parquetPartitions) Add(rec *iislog.Record) {
+	if p.err != nil {
+		return
+	}
+	day := "unknown"
+	if !rec.Time.IsZero() {
+		day = rec.Time.Format("2006-01-02")
+	}
+	key := filepath.Join("site="+p.site, "date="+day)
+	part, ok := p.open[key]
+	if !ok {
+		dir := filepath.Join(p.folder, key)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			p.err = err
+			return
+		}
+		p.seq++
+		path := filepath.Join(dir, fmt.Sprintf("%s.parquet.%d.tmp", p.name, p.seq))
+		f, err := os.Create(path)
+		if err != nil {
+			p.err = err
+			return
+		}
+		part = &parquetPartition{
+			path:   path,
+			file:   f,
+			writer: parquet.NewGenericWriter[parquetRow](f, p.options...),
+			rows:   make([]parquetRow, 0, parquetBatchSize),
+		}
+		p.open[key] = part
+	}
+	part.rows = append(part.rows, newParquetRow(rec))
+	if len(part.rows) == parquetBatchSize {
+		p.err = part.flush()
+	}
+}
+
+func (part *parquetPartition) flush() error {
+	if len(part.rows) == 0 {
+		return nil
+	}
+	if _, err := part.writer.Write(part.rows); err != nil {
+		return fmt.Errorf("write %s: %v", part.path, err)
+	}
+	part.count += int64(len(part.rows))
+	part.rows = part.rows[:0]
+	return nil
+}
+
+// commit finishes the segments of the current log file. On error they are rolled back and the error is
+// returned; the rows of the earlier files are kept.
+func (p *parquetPartitions) commit() error {
+	err := p.err
+	for _, part := range p.open {
+		if err == nil {
+			err = part.flush()
+		}
+		if err == nil {
+			if cerr := part.writer.Close(); cerr != nil {
+				err = fmt.Errorf("close %s: %v", part.path, cerr)
+			}
+		}
+		if cerr := part.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		for _, part := range p.open {
+			_ = os.Remove(part.path)
+		}
+	} else {
+		for key, part := range p.open {
+			p.segments[key] = append(p.segments[key], parquetSegment{path: part.path, count: part.count})
+		}
+	}
+	p.open = make(map[string]*parquetPartition)
+	p.err = nil
+	return err
+}
+
+// rollback discards the rows of the current log file
+func (p *parquetPartitions) rollback() {
+	for _, part := range p.open {
+		_ = part.file.Close()
+		_ = os.Remove(part.path)
+	}
+	p.open = make(map[string]*parquetPartition)
+	p.err = nil
+}
+
+// abort discards the partitions written so far
+func (p *parquetPartitions) abort() {
+	p.rollback()
+	for _, segs := range p.segments {
+		for _, seg := range segs {
+			_ = os.Remove(seg.path)
+		}
+	}
+	p.segments = make(map[string][]parquetSegment)
+}
+
+// Close joins the committed segments of every partition and moves the files into place. On error all
+// temporary files are removed. It returns the written files with their sizes.
+func (p *parquetPartitions) Close() (map[string]int64, error) {
+	p.rollback()
+	keys := make([]string, 0, len(p.segments))
+	for k := range p.segments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	written := make(map[string]int64, len(keys))
+	for i, k := range keys {
+		path := filepath.Join(p.folder, k, p.name+".parquet")
+		rows, err := p.join(path, p.segments[k])
+		if err != nil {
+			for _, k := range keys[i:] {
+				for _, seg := range p.segments[k] {
+					_ = os.Remove(seg.path)
+				}
+			}
+			return written, err
+		}
+		if info, err := os.Stat(path); err == nil {
+			written[path] = info.Size()
+		}
+		logger.Info("parquet written", "path", path, "rows", rows)
+	}
+	return written, nil
+}
+
+// join writes the segments of a partition to path, copying their row groups unless there is only one,
+// and removes them. It returns the number of rows.
+func (p *parquetPartitions) join(path string, segs []parquetSegment) (int64, error) {
+	if len(segs) == 1 {
+		return segs[0].count, os.Rename(segs[0].path, path)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := parquet.NewGenericWriter[parquetRow](f, p.options...)
+	var rows int64
+	for _, seg := range segs {
+		n, err := copyParquetRowGroups(w, seg.path)
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return 0, fmt.Errorf("join %s: %v", seg.path, err)
+		}
+		rows += n
+	}
+	err = w.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("close %s: %v", path, err)
+	}
+	for _, seg := range segs {
+		_ = os.Remove(seg.path)
+	}
+	return rows, nil
+}
+
+// copyParquetRowGroups appends the row groups of the Parquet file at path to w
+func copyParquetRowGroups(w *parquet.GenericWriter[parquetRow], path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	var rows int64
+	for _, rg := range pf.RowGroups() {
+		n, err := w.WriteRowGroup(rg)
+		if err != nil {
+			return rows, err
+		}
+		rows += n
+	}
+	return rows, nil
+}
+
+// isParquetFile reports whether name is a Parquet file written by this tool
+func isParquetFile(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".parquet")
+}
+
+// findParquetFiles returns the Parquet files below folder, sorted by path; a missing folder has none
+func findParquetFiles(folder string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == folder && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.IsDir() && isParquetFile(info.Name()) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// readParquetRows passes the rows of a Parquet file to fn in batches
+func readParquetRows(path string, fn func(rows []parquetRow)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, rg := range pf.RowGroups() {
+		if err := readParquetRowGroup(rg, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readParquetRowGroup(rg parquet.RowGroup, fn func(rows []parquetRow)) error {
+	r := parquet.NewGenericRowGroupReader[parquetRow](rg)
+	defer r.Close()
+	rows := make([]parquetRow, 1024)
+	for {
+		n, err := r.Read(rows)
+		if n > 0 {
+			fn(rows[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeParquet finishes the Parquet output of a group and writes a checksum sidecar for every file. It
+// returns the files relative to the parquet folder, sorted, and their total size.
+func closeParquet(pq *parquetPartitions, groupKey string) ([]string, int64, error) {
+	written, err := pq.Close()
+	files := make([]string, 0, len(written))
+	var size int64
+	for path, n := range written {
+		if cerr := writeChecksumSidecar(path); cerr != nil {
+			addError("checksum_failed", groupKey, path, cerr.Error())
+		}
+		size += n
+		if rel, rerr := filepath.Rel(config.Parquet.Folder, path); rerr == nil {
+			path = rel
+		}
+		files = append(files, filepath.ToSlash(path))
+	}
+	sort.Strings(files)
+	return files, size, err
+}
+
+// convertGroupToParquet writes the records of a group to Parquet instead of a zip archive and records the
+// outcome in res. Every file gets a checksum sidecar, and "<name>.manifest.json" in the parquet folder lists
+// the converted logs. Originals are only deleted when every line of the file was converted. A cancelled ctx
+// discards the output of the group and returns ctx.Err().
+func convertGroupToParquet(ctx context.Context, name string, files []LogFile, res *GroupResult) error {
+	pq := newParquetPartitions(name)
+	nd := createAlongsideNDJSON(name)
+	manifestPath := filepath.Join(config.Parquet.Folder, name)
+	manifest := newManifest(manifestPath, res.Group)
+	var traffic *TrafficStats
+	if config.TrafficStats {
+		traffic = newTrafficStats()
+	}
+	if redaction != nil {
+		manifest.Redaction = redaction.profile()
+	}
+	converted := make([]string, 0, len(files))
+	cancelled := func() error {
+		pq.abort()
+		if nd != nil {
+			nd.abort()
+		}
+		return ctx.Err()
+	}
+	for _, lf := range files {
+		if ctx.Err() != nil {
+			return cancelled()
+		}
+		srcFile, err := os.Open(lf.Path)
+		if err != nil {
+			addError("open_failed", res.Group, lf.Path, fmt.Sprintf("open %s: %v", lf.Path, err))
+			continue
+		}
+		pq.setSite(siteForPath(lf.Path))
+		if nd != nil {
+			nd.setSource("", filepath.Base(lf.Path), siteForPath(lf.Path))
+		}
+		var fileTraffic *TrafficStats
+		if traffic != nil {
+			fileTraffic = newTrafficStats()
+		}
+		_, malformed, err := copyLogFile(io.Discard, &contextReader{ctx: ctx, r: srcFile}, recordHandler(fileTraffic, pq, nd))
+		_ = srcFile.Close()
+		if ctx.Err() != nil {
+			return cancelled()
+		}
+		if err == nil {
+			err = pq.commit()
+		} else {
+			pq.rollback()
+		}
+		if err != nil {
+			addError("parquet_failed", res.Group, lf.Path, fmt.Sprintf("parquet convert %s: %v", lf.Path, err))
+			continue
+		}
+		if fileTraffic != nil {
+			fileTraffic.Malformed += malformed
+			traffic.Merge(fileTraffic)
+		}
+
+		mu.Lock()
+		stats.FilesProcessed++
+		stats.FilesCompressed++
+		stats.TotalSizeBefore += lf.Size
+		mu.Unlock()
+		res.Files++
+		res.BytesBefore += lf.Size
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Index:        len(manifest.Entries),
+			Name:         filepath.Base(lf.Path),
+			SourcePath:   lf.Path,
+			Site:         siteForPath(lf.Path),
+			Format:       lf.Format.String(),
+			Size:         lf.Size,
+			DroppedLines: malformed,
+			ModTime:      lf.ModTime,
+		})
+
+		if malformed > 0 {
+			addWarning("malformed_lines", lf.Path, "%d lines of %s could not be parsed; keeping the original", malformed, lf.Path)
+			continue
+		}
+		converted = append(converted, lf.Path)
+	}
+
+	if nd != nil {
+		manifest.NDJSON = finishAlongsideNDJSON(nd)
+	}
+	parquetFiles, size, err := closeParquet(pq, res.Group)
+	if err != nil {
+		return fmt.Errorf("parquet output: %v", err)
+	}
+	manifest.Parquet = parquetFiles
+	if traffic != nil {
+		manifest.Traffic = traffic.Summary()
+	}
+	mu.Lock()
+	stats.TotalSizeAfter += size
+	res.BytesAfter += size
+	if traffic != nil {
+		stats.Traffic.Merge(traffic)
+	}
+	mu.Unlock()
+	if len(manifest.Entries) > 0 {
+		if err := writeManifest(manifestPath, manifest); err != nil {
+			addError("manifest_failed", res.Group, manifestPath, err.Error())
+		}
+		mu.Lock()
+		stats.Manifests = append(stats.Manifests, manifest)
+		mu.Unlock()
+	}
+
+	if config.DeleteOriginalAfterCompress {
+		for _, path := range converted {
+			if err := deleteWithRetry(path, 3, 500*time.Millisecond); err != nil {
+				addWarning("delete_failed", path, "Failed to remove original file %s: %v", path, err)
+			} else {
+				res.Deleted++
+			}
+		}
+	}
+	return nil
+}
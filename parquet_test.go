@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-log-compressor/iislog"
+)
+
+// addTestRecords parses W3C log lines and adds their records to p
+func addTestRecords(t *testing.T, p *parquetPartitions, lines ...string) {
+	t.Helper()
+	lr := iislog.NewReader(strings.NewReader("#Fields: date time cs-uri-stem sc-status sc-bytes\r\n" + strings.Join(lines, "\r\n")))
+	for lr.Next() {
+		p.Add(lr.Record())
+	}
+	if err := lr.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestParquet returns the rows of a Parquet file
+func readTestParquet(t *testing.T, path string) []parquetRow {
+	t.Helper()
+	var rows []parquetRow
+	if err := readParquetRows(path, func(batch []parquetRow) { rows = append(rows, batch...) }); err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return rows
+}
+
+// useTestParquetFolder points the Parquet output at a temporary folder for the test
+func useTestParquetFolder(t *testing.T) string {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.DestFolder = t.TempDir()
+	config.Parquet = ParquetConfig{Mode: "replace"}
+	if err := validateParquetConfig(&config.Parquet); err != nil {
+		t.Fatal(err)
+	}
+	return config.Parquet.Folder
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	folder := useTestParquetFolder(t)
+	p := newParquetPartitions("logs_2024-05")
+
+	p.setSite("W3SVC1")
+	addTestRecords(t, p,
+		"2024-05-03 10:00:00 /a 200 512",
+		"2024-05-03 10:00:01 /b 404 -",
+		"2024-05-04 00:00:00 /c 200 100")
+	if err := p.commit(); err != nil {
+		t.Fatal(err)
+	}
+	// A file that fails part-way leaves none of its rows
+	addTestRecords(t, p, "2024-05-03 11:00:00 /failed 500 1")
+	p.rollback()
+	// A second file of the same partition is joined with the first
+	addTestRecords(t, p, "2024-05-03 12:00:00 /d 200 1")
+	if err := p.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	day3 := filepath.Join(folder, "site=W3SVC1", "date=2024-05-03", "logs_2024-05.parquet")
+	day4 := filepath.Join(folder, "site=W3SVC1", "date=2024-05-04", "logs_2024-05.parquet")
+	if len(written) != 2 || written[day3] == 0 || written[day4] == 0 {
+		t.Fatalf("written = %v, want %s and %s", written, day3, day4)
+	}
+
+	rows := readTestParquet(t, day3)
+	var uris []string
+	for _, r := range rows {
+		uris = append(uris, r.URIStem)
+	}
+	if strings.Join(uris, " ") != "/a /b /d" {
+		t.Errorf("rows %v, want /a /b /d", uris)
+	}
+	first := rows[0]
+	if first.Time != time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC).UnixMilli() {
+		t.Errorf("time = %v, want 2024-05-03 10:00:00 UTC", first.Time)
+	}
+	if first.Status == nil || *first.Status != 200 || first.BytesSent == nil || *first.BytesSent != 512 {
+		t.Errorf("numeric fields not kept: %+v", first)
+	}
+	if rows[1].BytesSent != nil {
+		t.Errorf("sc-bytes \"-\" = %d, want null", *rows[1].BytesSent)
+	}
+
+	tmp, _ := filepath.Glob(filepath.Join(folder, "*", "*", "*.tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("temporary files left: %v", tmp)
+	}
+}
+
+func TestParquetRowWithoutTime(t *testing.T) {
+	lr := iislog.NewReader(strings.NewReader("#Fields: cs-uri-stem sc-status\r\n/a 200\r\n"))
+	if !lr.Next() {
+		t.Fatalf("no record: %v", lr.Err())
+	}
+	if row := newParquetRow(lr.Record()); row.Time != 0 {
+		t.Errorf("time = %d, want null for a record without date and time", row.Time)
+	}
+}
+
+func TestConvertGroupToParquet(t *testing.T) {
+	folder := useTestParquetFolder(t)
+	config.SourceFolder = t.TempDir()
+	var paths []string
+	for site, line := range map[string]string{
+		"W3SVC1": "2024-05-03 10:00:00 /one 200 1",
+		"W3SVC2": "2024-05-03 10:00:00 /two 200 2",
+	} {
+		dir := filepath.Join(config.SourceFolder, site)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "u_ex240503.log")
+		if err := os.WriteFile(path, []byte("#Fields: date time cs-uri-stem sc-status sc-bytes\r\n"+line+"\r\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var files []LogFile
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, LogFile{Path: p, Size: info.Size(), ModTime: info.ModTime(), Format: iislog.FormatW3C})
+	}
+
+	res := &GroupResult{Group: "2024-05-03"}
+	if err := convertGroupToParquet(context.Background(), "logs_2024-05-03", files, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 2 {
+		t.Errorf("%d files converted, want 2", res.Files)
+	}
+	m, err := readManifest(filepath.Join(folder, "logs_2024-05-03"))
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	want := []string{
+		"site=W3SVC1/date=2024-05-03/logs_2024-05-03.parquet",
+		"site=W3SVC2/date=2024-05-03/logs_2024-05-03.parquet",
+	}
+	if strings.Join(m.Parquet, " ") != strings.Join(want, " ") || len(m.Entries) != 2 {
+		t.Errorf("manifest lists %v and %d entries, want %v and 2 entries", m.Parquet, len(m.Entries), want)
+	}
+	for _, rel := range want {
+		if r := verifyParquet(filepath.Join(folder, filepath.FromSlash(rel))); !r.Passed || r.MissingChecksum || r.Entries != 1 {
+			t.Errorf("verify %s: %+v", rel, r)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+// processAlive cannot check processes on this platform; locks are only treated as stale by lock_stale_hours
+func processAlive(pid int) bool {
+	return true
+}
+
+// processStartID cannot identify processes on this platform
+func processStartID(pid int) string {
+	return ""
+}
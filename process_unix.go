@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processAlive reports whether a process with this PID exists on this host
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// processStartID identifies the process with this PID by its boot and start time, so that a PID reused
+// after a crash or reboot is told apart from the process that wrote a lock. It reads /proc and returns ""
+// where that is not available.
+func processStartID(pid int) string {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	// The command name in parentheses may contain spaces; starttime is the 20th field after it
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return strings.TrimSpace(string(bootID)) + ":" + fields[19]
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code Windows reports for a process that has not exited
+const stillActive = 259
+
+// processAlive reports whether a process with this PID exists on this host
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access denied means the process exists but belongs to another user
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// processStartID identifies the process with this PID by its creation time, so that a PID reused after a
+// crash or reboot is told apart from the process that wrote a lock. It returns "" if the process cannot
+// be queried.
+func processStartID(pid int) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return ""
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10)
+}
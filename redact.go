@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"iis-log-compressor/iislog"
+)
+
+// RedactionConfig holds the privacy settings applied to log records before they are archived
+type RedactionConfig struct {
+	Enabled          bool     `json:"enabled"`
+	ClientIP         string   `json:"client_ip"` // "", "truncate" or "hmac"
+	HMACKey          string   `json:"hmac_key"`
+	DropUsername     bool     `json:"drop_username"`
+	QueryPatterns    []string `json:"query_patterns"`
+	QueryReplacement string   `json:"query_replacement"`
+}
+
+// RedactionProfile records in the manifest which redaction was applied to an archive
+type RedactionProfile struct {
+	ClientIP         string   `json:"client_ip,omitempty"`
+	HMACKeyID        string   `json:"hmac_key_id,omitempty"`
+	DropUsername     bool     `json:"drop_username"`
+	QueryPatterns    []string `json:"query_patterns,omitempty"`
+	QueryReplacement string   `json:"query_replacement,omitempty"`
+	DroppedLines     int64    `json:"dropped_lines"`
+}
+
+// redactor rewrites the personal data fields of log records
+type redactor struct {
+	cfg     RedactionConfig
+	key     []byte
+	queries []*regexp.Regexp
+}
+
+// newRedactor validates the redaction settings and compiles the query patterns
+func newRedactor(cfg RedactionConfig) (*redactor, error) {
+	cfg.ClientIP = strings.ToLower(strings.TrimSpace(cfg.ClientIP))
+	switch cfg.ClientIP {
+	case "", "truncate":
+	case "hmac":
+		if cfg.HMACKey == "" {
+			return nil, fmt.Errorf("redaction.hmac_key is required when client_ip is \"hmac\"")
+		}
+	default:
+		return nil, fmt.Errorf("redaction.client_ip must be \"truncate\" or \"hmac\", got %q", cfg.ClientIP)
+	}
+	if cfg.QueryReplacement == "" {
+		cfg.QueryReplacement = "REDACTED"
+	}
+	r := &redactor{cfg: cfg, key: []byte(cfg.HMACKey)}
+	for _, p := range cfg.QueryPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redaction.query_patterns %q: %v", p, err)
+		}
+		r.queries = append(r.queries, re)
+	}
+	return r, nil
+}
+
+// profile describes the redaction for the manifest; the HMAC key is identified by a digest prefix, never stored
+func (r *redactor) profile() *RedactionProfile {
+	p := &RedactionProfile{
+		ClientIP:      r.cfg.ClientIP,
+		DropUsername:  r.cfg.DropUsername,
+		QueryPatterns: r.cfg.QueryPatterns,
+	}
+	if r.cfg.ClientIP == "hmac" {
+		p.ClientIP = "hmac-sha256"
+		sum := sha256.Sum256(r.key)
+		p.HMACKeyID = hex.EncodeToString(sum[:4])
+	}
+	if len(r.queries) > 0 {
+		p.QueryReplacement = r.cfg.QueryReplacement
+	}
+	return p
+}
+
+// truncateIP zeroes the host part of an address: the last octet for IPv4, all but the /48 prefix for IPv6
+func truncateIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "-"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// apply rewrites the personal data fields of a record in place
+func (r *redactor) apply(rec *iislog.Record) {
+	if ip := rec.Get(iislog.FieldClientIP); ip != "" {
+		switch r.cfg.ClientIP {
+		case "truncate":
+			rec.Set(iislog.FieldClientIP, truncateIP(ip))
+		case "hmac":
+			mac := hmac.New(sha256.New, r.key)
+			mac.Write([]byte(ip))
+			rec.Set(iislog.FieldClientIP, hex.EncodeToString(mac.Sum(nil))[:16])
+		}
+	}
+	if r.cfg.DropUsername && rec.Get(iislog.FieldUsername) != "" {
+		rec.Set(iislog.FieldUsername, "")
+	}
+	if q := rec.Get(iislog.FieldURIQuery); q != "" && len(r.queries) > 0 {
+		scrubbed := q
+		for _, re := range r.queries {
+			scrubbed = re.ReplaceAllString(scrubbed, r.cfg.QueryReplacement)
+		}
+		if scrubbed != q {
+			rec.Set(iislog.FieldURIQuery, scrubbed)
+		}
+	}
+}
+
+// redactCopy writes src to dst with every record redacted. Directive lines are kept; lines that
+// cannot be parsed are dropped because they cannot be redacted safely. Records are passed to fn
+// after redaction when fn is not nil. It returns the number of dropped lines.
+func redactCopy(dst io.Writer, src io.Reader, r *redactor, fn func(*iislog.Record)) (int64, error) {
+	bw := bufio.NewWriter(dst)
+	lr := iislog.NewReader(src)
+	lr.OnDirective = func(line string) {
+		bw.WriteString(line)
+		bw.WriteString("\r\n")
+	}
+	for lr.Next() {
+		rec := lr.Record()
+		r.apply(rec)
+		if fn != nil {
+			fn(rec)
+		}
+		bw.WriteString(rec.String())
+		bw.WriteString("\r\n")
+	}
+	dropped := int64(lr.Malformed())
+	if err := lr.Err(); err != nil {
+		return dropped, err
+	}
+	return dropped, bw.Flush()
+}
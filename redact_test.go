@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-log-compressor/iislog"
+)
+
+func TestRedactCopy(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{Enabled: true, ClientIP: "truncate", DropUsername: true, QueryPatterns: []string{`token=[^&]*`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		input       string
+		want        string
+		wantDropped int64
+	}{
+		{
+			name: "w3c",
+			input: "#Fields: date time c-ip cs-username cs-uri-query sc-status\r\n" +
+				"2024-05-01 00:00:01 192.168.1.23 alice token=abc&x=1 200\r\n",
+			want: "#Fields: date time c-ip cs-username cs-uri-query sc-status\r\n" +
+				"2024-05-01 00:00:01 192.168.1.0 - REDACTED&x=1 200\r\n",
+		},
+		{
+			name:        "unknown format",
+			input:       "app started\r\nuser alice logged in from 10.0.0.7\r\n",
+			want:        "",
+			wantDropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			dropped, err := redactCopy(&out, strings.NewReader(tt.input), r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output:\n%q\nwant:\n%q", out.String(), tt.want)
+			}
+			if dropped != tt.wantDropped {
+				t.Errorf("dropped %d lines, want %d", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+// TestRedactionKeepsUnparseableOriginal archives a file whose lines redaction cannot parse and checks that
+// the entry fails verification, so the original is not deleted
+func TestRedactionKeepsUnparseableOriginal(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{Enabled: true, ClientIP: "truncate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := redaction
+	defer func() { redaction = saved }()
+	redaction = r
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app_log.txt")
+	if err := os.WriteFile(source, []byte("app started\r\nuser alice logged in from 10.0.0.7\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(dir, "logs.zip")
+	dest, err := os.Create(destPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Manifest{Group: "2024-05"}
+	files := []LogFile{{Path: source, Size: info.Size(), ModTime: time.Now(), Format: iislog.FormatW3C}}
+	if err := addFilesToZip(context.Background(), dest, files, destPath, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Entries) != 1 || manifest.Entries[0].DroppedLines != 2 {
+		t.Fatalf("manifest entries = %+v, want one entry with 2 dropped lines", manifest.Entries)
+	}
+	if verified := verifyZipContainsAll(destPath, manifest.Entries); verified[source] {
+		t.Error("entry without the dropped lines verified, the original would be deleted")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RemoteTargetConfig describes one remote location finished archives are copied to
+type RemoteTargetConfig struct {
+	Name  string      `json:"name"` // used in messages and the report; defaults to the type
+	Type  string      `json:"type"` // "s3", "sftp" or "azure"
+	S3    S3Config    `json:"s3"`
+	SFTP  SFTPConfig  `json:"sftp"`
+	Azure AzureConfig `json:"azure"`
+}
+
+// UploadResult records the upload of one file to one remote target
+type UploadResult struct {
+	Target   string
+	File     string
+	Location string
+	Size     int64
+	Duration time.Duration
+	Err      string
+}
+
+// remoteUpload is a local file handed to a remote target, with the archive details used in remote names
+type remoteUpload struct {
+	LocalPath string
+	Name      string    // file name without folder
+	Group     string    // group key, e.g. 2024-05 or 2024-05-03
+	Period    time.Time // start of the group period
+	Host      string
+	Sites     []string
+}
+
+// remoteTarget copies files to remote storage. Upload returns the remote location and only succeeds once
+// the remote side has confirmed the complete file; a cancelled ctx aborts it with ctx.Err().
+type remoteTarget interface {
+	Name() string
+	Upload(ctx context.Context, u remoteUpload) (string, error)
+}
+
+// remoteCleaner is implemented by targets that apply retention to the remote copies at the end of a run
+type remoteCleaner interface {
+	Cleanup() error
+}
+
+// setupRemoteTargets builds the remote targets of the loaded configuration. Only the commands that archive
+// call it, so the read-only subcommands start without remote credentials or known_hosts.
+func setupRemoteTargets() error {
+	targets, err := newRemoteTargets(config.RemoteTargets)
+	if err != nil {
+		return err
+	}
+	remotes = targets
+	return nil
+}
+
+// newRemoteTargets builds the remote targets from the configuration
+func newRemoteTargets(cfgs []RemoteTargetConfig) ([]remoteTarget, error) {
+	targets := make([]remoteTarget, 0, len(cfgs))
+	for i, c := range cfgs {
+		kind := strings.ToLower(strings.TrimSpace(c.Type))
+		name := c.Name
+		if name == "" {
+			name = kind
+		}
+		var t remoteTarget
+		var err error
+		switch kind {
+		case "s3":
+			t, err = newS3Target(name, c.S3)
+		case "sftp":
+			t, err = newSFTPTarget(name, c.SFTP)
+		case "azure":
+			t, err = newAzureTarget(name, c.Azure)
+		default:
+			err = fmt.Errorf("unsupported type %q (supported: s3, sftp, azure)", c.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("remote_targets[%d] %s: %v", i, name, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// expandRemotePrefix fills a remote path template: %Y, %y, %m and %d come from the group period,
+// %h is the host name and %g the group key
+func expandRemotePrefix(tmpl string, u remoteUpload) string {
+	r := strings.NewReplacer(
+		"%Y", u.Period.Format("2006"),
+		"%y", u.Period.Format("06"),
+		"%m", u.Period.Format("01"),
+		"%d", u.Period.Format("02"),
+		"%h", u.Host,
+		"%g", u.Group,
+	)
+	return r.Replace(tmpl)
+}
+
+// groupPeriod returns the start of the period of a group key produced by groupKeyForTime
+func groupPeriod(groupKey string) time.Time {
+	for _, layout := range []string{"2006-01-02", "2006-01"} {
+		if t, err := time.Parse(layout, groupKey); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// uploadArchive is the post-archive hook for remote targets: the archive and its sidecar files are copied
+// to every target. It returns true only when every target confirmed every file. Uploads cut short by a
+// cancelled ctx are recorded as "cancelled" without adding a run error.
+func uploadArchive(ctx context.Context, archivePath string, manifest *Manifest) bool {
+	sites := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		if e.Site != "" {
+			sites[e.Site] = true
+		}
+	}
+	siteList := make([]string, 0, len(sites))
+	for s := range sites {
+		siteList = append(siteList, s)
+	}
+	sort.Strings(siteList)
+
+	files := []string{archivePath}
+	for _, s := range archiveSidecars(archivePath) {
+		if _, err := os.Stat(s); err == nil {
+			files = append(files, s)
+		}
+	}
+
+	allOK := true
+	for _, target := range remotes {
+		for _, path := range files {
+			if ctx.Err() != nil {
+				return false
+			}
+			u := remoteUpload{
+				LocalPath: path,
+				Name:      filepath.Base(path),
+				Group:     manifest.Group,
+				Period:    groupPeriod(manifest.Group),
+				Host:      manifest.Host,
+				Sites:     siteList,
+			}
+			res := UploadResult{Target: target.Name(), File: path}
+			if info, err := os.Stat(path); err == nil {
+				res.Size = info.Size()
+			}
+			start := time.Now()
+			location, err := target.Upload(ctx, u)
+			res.Location = location
+			res.Duration = time.Since(start)
+			cancelled := err != nil && ctx.Err() != nil
+			if err != nil {
+				allOK = false
+				res.Err = err.Error()
+				if cancelled {
+					res.Err = "cancelled"
+				}
+			} else {
+				logger.Info("uploaded", "group", u.Group, pathAttr(path), "target", target.Name(), "location", location,
+					"bytes", res.Size, "duration_seconds", res.Duration.Seconds())
+			}
+			mu.Lock()
+			stats.Uploads = append(stats.Uploads, res)
+			mu.Unlock()
+			if err != nil && !cancelled {
+				addError("upload_failed", u.Group, path, fmt.Sprintf("upload %s to %s: %v", path, target.Name(), err))
+			}
+		}
+	}
+	return allOK
+}
+
+// finishRemoteTargets applies remote retention and closes open connections at the end of a run; remote
+// retention is skipped when the run was cancelled
+func finishRemoteTargets(ctx context.Context) {
+	for _, t := range remotes {
+		if c, ok := t.(remoteCleaner); ok && ctx.Err() == nil {
+			if err := c.Cleanup(); err != nil {
+				addWarning("remote_retention_failed", "", "remote cleanup on %s failed: %v", t.Name(), err)
+			}
+		}
+		if c, ok := t.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+// withoutURL drops the request URL from a *url.Error, whose message would otherwise carry credentials in
+// the URL (an Azure SAS token, the secret path of a Slack or Teams webhook) into logs and reports
+func withoutURL(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return fmt.Errorf("%s: %w", ue.Op, ue.Err)
+	}
+	return err
+}
+
+// encodeBase64 returns the standard base64 encoding used by Content-MD5 style headers
+func encodeBase64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
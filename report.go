@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is increased when fields of the JSON run report change meaning or are removed
+const reportSchemaVersion = 1
+
+// RunReport is the machine-readable run report written to report_dir; the schema is documented in README.txt
+type RunReport struct {
+	SchemaVersion int `json:"schema_version"`
+	*RunSummary
+	SourceFolder  string               `json:"source_folder"`
+	DestFolder    string               `json:"dest_folder"`
+	ArchiveScope  string               `json:"archive_scope"`
+	Results       []*GroupResult       `json:"group_results"`
+	Issues        []RunIssue           `json:"issues"`
+	Retention     []RetentionAction    `json:"retention"`
+	Notifications []NotificationResult `json:"notifications"`
+	Phases        []PhaseTiming        `json:"phases"`
+}
+
+// GroupResult is the outcome of archiving one group (month or day)
+type GroupResult struct {
+	Group           string       `json:"group"`
+	Archive         string       `json:"archive"` // archive path, or the parquet folder in parquet replace mode
+	FilesFound      int          `json:"files_found"`
+	Files           int          `json:"files"` // files written to the archive
+	BytesBefore     int64        `json:"bytes_before"`
+	BytesAfter      int64        `json:"bytes_after"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Verify          string       `json:"verify"` // "ok", "failed" or "skipped"
+	VerifiedFiles   int          `json:"verified_files"`
+	Deleted         int          `json:"deleted"` // original log files removed
+	Uploaded        bool         `json:"uploaded"`
+	LocalRemoved    bool         `json:"local_removed"` // archive removed after upload
+	Error           string       `json:"error,omitempty"`
+	Sites           []SiteVolume `json:"sites,omitempty"` // log volume found per site folder
+}
+
+// RunIssue is an error or warning with a stable code
+type RunIssue struct {
+	Level   string `json:"level"` // "error" or "warning"
+	Code    string `json:"code"`
+	Group   string `json:"group,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// RetentionAction is an archive removed by retention_days or keep_last_n_archives
+type RetentionAction struct {
+	Path  string `json:"path"`
+	Rule  string `json:"rule"` // "retention_days" or "keep_last_n_archives"
+	Error string `json:"error,omitempty"`
+}
+
+// NotificationResult is the outcome of one notification channel
+type NotificationResult struct {
+	Channel string `json:"channel"` // "email" or "webhook"
+	Name    string `json:"name"`
+	Status  string `json:"status"` // "sent", "failed", "skipped" or "disabled"
+	Detail  string `json:"detail,omitempty"`
+}
+
+// recordNotification adds the outcome of a notification to the run
+func recordNotification(channel, name, status, detail string) {
+	level := slog.LevelInfo
+	if status == "failed" {
+		level = slog.LevelError
+	}
+	logger.Log(context.Background(), level, "notification", "channel", channel, "name", name, "status", status, "detail", detail)
+	stats.Notifications = append(stats.Notifications, NotificationResult{Channel: channel, Name: name, Status: status, Detail: detail})
+}
+
+// recordRetention adds a retention removal to the run
+func recordRetention(path, rule string, err error) {
+	a := RetentionAction{Path: path, Rule: rule}
+	if err != nil {
+		a.Error = err.Error()
+		logger.Error("retention removal failed", pathAttr(path), "rule", rule, "error", err)
+	} else {
+		logger.Info("removed by retention", pathAttr(path), "rule", rule)
+	}
+	mu.Lock()
+	stats.Retention = append(stats.Retention, a)
+	mu.Unlock()
+}
+
+// validateReportConfig applies the report defaults
+func validateReportConfig() {
+	if config.ReportRetentionDays < 0 {
+		config.ReportRetentionDays = 0
+	}
+}
+
+// newRunReport captures the current stats as a JSON run report
+func newRunReport() *RunReport {
+	r := &RunReport{
+		SchemaVersion: reportSchemaVersion,
+		RunSummary:    newRunSummary(),
+		SourceFolder:  config.SourceFolder,
+		DestFolder:    config.DestFolder,
+		ArchiveScope:  strings.ToLower(config.ArchiveScope),
+		Results:       append([]*GroupResult{}, stats.Groups...),
+		Issues:        append([]RunIssue{}, stats.Issues...),
+		Retention:     append([]RetentionAction{}, stats.Retention...),
+		Notifications: append([]NotificationResult{}, stats.Notifications...),
+		Phases:        append([]PhaseTiming{}, stats.Phases...),
+	}
+	sort.Slice(r.Results, func(i, j int) bool { return r.Results[i].Group < r.Results[j].Group })
+	return r
+}
+
+// writeJSONReport writes run_report_<time>.json to report_dir and applies report_retention_days.
+// The file is written under a temporary name first so scrapers never read a partial report.
+func writeJSONReport() (string, error) {
+	if config.ReportDir == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(config.ReportDir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(newRunReport(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(config.ReportDir, fmt.Sprintf("run_report_%s.json", stats.EndTime.Format("20060102_150405")))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	cleanupJSONReports()
+	return path, nil
+}
+
+// cleanupJSONReports removes JSON run reports older than report_retention_days
+func cleanupJSONReports() {
+	if config.ReportRetentionDays <= 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -config.ReportRetentionDays)
+	entries, err := os.ReadDir(config.ReportDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "run_report_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(config.ReportDir, name)); err == nil {
+			logger.Info("old run report removed", "path", name)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Attempts      = 3
+	s3MinPartSize   = 5 << 20
+	s3MaxParts      = 10000
+	s3EmptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3DefaultRegion = "us-east-1"
+)
+
+// S3Config describes an S3-compatible bucket (AWS S3, MinIO, Ceph, ...)
+type S3Config struct {
+	Endpoint        string `json:"endpoint"`          // defaults to https://s3.<region>.amazonaws.com
+	Region          string `json:"region"`            // defaults to us-east-1
+	Bucket          string `json:"bucket"`            // required
+	AccessKeyID     string `json:"access_key_id"`     // defaults to AWS_ACCESS_KEY_ID
+	SecretAccessKey string `json:"secret_access_key"` // defaults to AWS_SECRET_ACCESS_KEY
+	SessionToken    string `json:"session_token"`     // defaults to AWS_SESSION_TOKEN
+	Prefix          string `json:"prefix"`            // key prefix template, e.g. "iis/%h/%Y/%m/"
+	StorageClass    string `json:"storage_class"`     // e.g. STANDARD_IA or GLACIER_IR; empty for the bucket default
+	PathStyle       bool   `json:"path_style"`        // bucket in the path instead of the host name, needed for MinIO
+	PartSizeMB      int    `json:"part_size_mb"`      // files larger than this use multipart upload, default 16
+	Verify          string `json:"verify"`            // "etag" (default) or "size" for buckets with SSE-KMS, whose ETags are not MD5
+}
+
+// s3Target uploads files to an S3-compatible bucket using signature version 4
+type s3Target struct {
+	name     string
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	partSize int64
+}
+
+// newS3Target validates the settings of an S3 target
+func newS3Target(name string, cfg S3Config) (*s3Target, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3.bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cfg.SecretAccessKey == "" {
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.SessionToken == "" {
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 credentials are missing (access_key_id/secret_access_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	}
+	cfg.Verify = strings.ToLower(strings.TrimSpace(cfg.Verify))
+	switch cfg.Verify {
+	case "":
+		cfg.Verify = "etag"
+	case "etag", "size":
+	default:
+		return nil, fmt.Errorf("s3.verify must be \"etag\" or \"size\", got %q", cfg.Verify)
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3.endpoint %q is not a valid URL", cfg.Endpoint)
+	}
+	partSize := int64(cfg.PartSizeMB) << 20
+	if partSize <= 0 {
+		partSize = 16 << 20
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 2 * time.Minute
+	return &s3Target{
+		name:     name,
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+		partSize: partSize,
+	}, nil
+}
+
+// Name returns the configured target name
+func (t *s3Target) Name() string {
+	return t.name
+}
+
+// Upload copies a file to the bucket, using multipart upload above the part size, and confirms it with
+// a HEAD request that must report the same size and ETag
+func (t *s3Target) Upload(ctx context.Context, u remoteUpload) (string, error) {
+	key := strings.TrimPrefix(expandRemotePrefix(t.cfg.Prefix, u)+u.Name, "/")
+	location := fmt.Sprintf("s3://%s/%s", t.cfg.Bucket, key)
+
+	info, err := os.Stat(u.LocalPath)
+	if err != nil {
+		return location, err
+	}
+	size := info.Size()
+	sum, err := fileSHA256(u.LocalPath)
+	if err != nil {
+		return location, err
+	}
+
+	var etag string
+	if size <= t.partSize {
+		etag, err = t.putObject(ctx, u.LocalPath, key, size, sum)
+	} else {
+		etag, err = t.multipartUpload(ctx, u.LocalPath, key, size, sum)
+	}
+	if err != nil {
+		return location, err
+	}
+	return location, t.confirm(ctx, key, size, etag)
+}
+
+// putObject uploads a small file in a single request and returns the expected ETag
+func (t *s3Target) putObject(ctx context.Context, path, key string, size int64, sum string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	md5sum, sha, err := hashSection(f, 0, size)
+	if err != nil {
+		return "", err
+	}
+	header := t.objectHeader(sum)
+	header.Set("Content-MD5", encodeBase64(md5sum))
+	resp, err := t.request(ctx, http.MethodPut, key, nil, header, sectionBody(f, 0, size), size, sha)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return hex.EncodeToString(md5sum), nil
+}
+
+// multipartUpload uploads a large file in parts and returns the expected multipart ETag.
+// The upload is aborted on failure so no orphaned parts are left in the bucket.
+func (t *s3Target) multipartUpload(ctx context.Context, path, key string, size int64, sum string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	partSize := t.partSize
+	if (size+partSize-1)/partSize > s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+
+	resp, err := t.request(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, t.objectHeader(sum), nil, 0, s3EmptySHA256)
+	if err != nil {
+		return "", fmt.Errorf("create multipart upload: %v", err)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil || created.UploadID == "" {
+		return "", fmt.Errorf("create multipart upload: no upload id in response (%v)", err)
+	}
+	uploadID := created.UploadID
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	var md5s []byte
+	abort := func(cause error) (string, error) {
+		// The abort also runs when ctx was cancelled, so it gets a context of its own
+		actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, err := t.request(actx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, s3EmptySHA256); err == nil {
+			resp.Body.Close()
+		}
+		return "", cause
+	}
+
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		md5sum, sha, err := hashSection(f, offset, n)
+		if err != nil {
+			return abort(err)
+		}
+		header := http.Header{}
+		header.Set("Content-MD5", encodeBase64(md5sum))
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := t.request(ctx, http.MethodPut, key, query, header, sectionBody(f, offset, n), n, sha)
+		if err != nil {
+			return abort(fmt.Errorf("upload part %d: %v", number, err))
+		}
+		resp.Body.Close()
+		etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+		if t.cfg.Verify == "etag" && !strings.EqualFold(etag, hex.EncodeToString(md5sum)) {
+			return abort(fmt.Errorf("upload part %d: ETag %s does not match MD5 %x", number, etag, md5sum))
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: `"` + etag + `"`})
+		md5s = append(md5s, md5sum...)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	bodySHA := sha256.Sum256(body)
+	resp, err = t.request(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil,
+		func() io.Reader { return bytes.NewReader(body) }, int64(len(body)), hex.EncodeToString(bodySHA[:]))
+	if err != nil {
+		return abort(fmt.Errorf("complete multipart upload: %v", err))
+	}
+	// S3 may report a failed completion with status 200 and an error document
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if err := parseStorageError(data); err != nil {
+		return abort(fmt.Errorf("complete multipart upload: %v", err))
+	}
+
+	combined := md5.Sum(md5s)
+	return fmt.Sprintf("%x-%d", combined, len(parts)), nil
+}
+
+// confirm checks with a HEAD request that the object has the expected size and ETag
+func (t *s3Target) confirm(ctx context.Context, key string, size int64, etag string) error {
+	resp, err := t.request(ctx, http.MethodHead, key, nil, nil, nil, 0, s3EmptySHA256)
+	if err != nil {
+		return fmt.Errorf("confirm upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != size {
+		return fmt.Errorf("confirm upload: remote size %d, local size %d", resp.ContentLength, size)
+	}
+	if t.cfg.Verify == "etag" {
+		if got := strings.Trim(resp.Header.Get("ETag"), `"`); !strings.EqualFold(got, etag) {
+			return fmt.Errorf("confirm upload: remote ETag %s, expected %s", got, etag)
+		}
+	}
+	return nil
+}
+
+// objectHeader returns the headers set when an object is created
+func (t *s3Target) objectHeader(sum string) http.Header {
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Sha256", sum)
+	if t.cfg.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", t.cfg.StorageClass)
+	}
+	return header
+}
+
+// request sends a signed request, retrying network errors and 5xx/429 responses. Responses with
+// other error statuses are returned as errors; the caller closes the body of successful responses.
+func (t *s3Target) request(ctx context.Context, method, key string, query url.Values, header http.Header, body func() io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	var lastErr error
+	for attempt := 1; attempt <= s3Attempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, time.Duration(attempt-1)*2*time.Second); err != nil {
+				return nil, err
+			}
+		}
+		req, err := t.newRequest(ctx, method, key, query, header, body, size, payloadHash)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		lastErr = parseStorageError(data)
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%s", resp.Status)
+		} else {
+			lastErr = fmt.Errorf("%s: %v", resp.Status, lastErr)
+		}
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// newRequest builds and signs a request for an object key
+func (t *s3Target) newRequest(ctx context.Context, method, key string, query url.Values, header http.Header, body func() io.Reader, size int64, payloadHash string) (*http.Request, error) {
+	u := *t.endpoint
+	path := "/" + key
+	if t.cfg.PathStyle {
+		path = "/" + t.cfg.Bucket + path
+	} else {
+		u.Host = t.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(t.endpoint.Path, "/") + path
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	var r io.Reader
+	if body != nil {
+		r = body()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3Request(req, t.cfg.Region, t.cfg.AccessKeyID, t.cfg.SecretAccessKey, t.cfg.SessionToken, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// signS3Request adds the AWS signature version 4 Authorization header to req
+func signS3Request(req *http.Request, region, accessKey, secretKey, sessionToken, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	canonicalRequest, signedHeaders := s3CanonicalRequest(req, payloadHash)
+	scope := day + "/" + region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalRequest returns the canonical request of a signed request and the list of signed headers
+func s3CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-md5" || lk == "content-type" || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	return canonicalRequest, signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as signature version 4 requires
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, which is both the canonical and the sent form
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// parseStorageError returns the error described by an S3 or Azure error document, or nil if data is not one
+func parseStorageError(data []byte) error {
+	var e struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
+
+// hashSection returns the MD5 digest and the hex encoded SHA-256 digest of n bytes at offset
+func hashSection(f *os.File, offset, n int64) ([]byte, string, error) {
+	m := md5.New()
+	s := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), io.NewSectionReader(f, offset, n)); err != nil {
+		return nil, "", err
+	}
+	return m.Sum(nil), hex.EncodeToString(s.Sum(nil)), nil
+}
+
+// sectionBody returns a request body factory that rereads the same part of the file on every attempt
+func sectionBody(f *os.File, offset, n int64) func() io.Reader {
+	return func() io.Reader {
+		return io.NewSectionReader(f, offset, n)
+	}
+}
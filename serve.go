@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ServeConfig controls the long-running "serve" mode
+type ServeConfig struct {
+	Schedule      string `json:"schedule"`       // cron expression or macro, default "0 2 * * *" (02:00 local time)
+	JitterSeconds int    `json:"jitter_seconds"` // random delay of up to this many seconds before each run
+	RunOnStart    bool   `json:"run_on_start"`   // run once immediately when the service starts
+}
+
+// validateServeConfig applies the serve defaults and checks the schedule
+func validateServeConfig(s *ServeConfig) error {
+	if s.Schedule == "" {
+		s.Schedule = "0 2 * * *"
+	}
+	if s.JitterSeconds < 0 {
+		s.JitterSeconds = 0
+	}
+	if _, err := parseCron(s.Schedule); err != nil {
+		return fmt.Errorf("serve.schedule: %v", err)
+	}
+	return nil
+}
+
+// runServe implements the "serve" subcommand: it runs the archiver on the configured schedule until
+// SIGTERM or SIGINT. A stop signal during a run cancels it, removes partial archives, writes the reports
+// of the cancelled run and exits; a second signal exits immediately. The exit code is that of the cancelled
+// run, or of the last run when the stop came between runs.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	scheduleFlag := fs.String("schedule", "", "cron expression overriding serve.schedule")
+	_ = fs.Parse(args)
+
+	if err := loadConfig(*configPath); err != nil {
+		logger.Error("failed to load config", "error", err)
+		return exitInvalidConfig
+	}
+	if err := setupRemoteTargets(); err != nil {
+		logger.Error("failed to load config", "error", err)
+		return exitInvalidConfig
+	}
+	if *scheduleFlag != "" {
+		config.Serve.Schedule = *scheduleFlag
+	}
+	sched, err := parseCron(config.Serve.Schedule)
+	if err != nil {
+		logger.Error("invalid schedule", "error", err)
+		return exitInvalidConfig
+	}
+	logFile, err := setupLogging(config.Logging)
+	if err != nil {
+		logger.Error("failed to set up logging", "error", err)
+		return exitInvalidConfig
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// Restore the default handling so a second signal terminates at once
+		stop()
+		logger.Info("stop requested, cancelling the current work")
+	}()
+
+	logger.Info("serve started", "schedule", config.Serve.Schedule, "jitter_seconds", config.Serve.JitterSeconds,
+		"run_on_start", config.Serve.RunOnStart)
+	code := exitSuccess
+	next := sched.Next(time.Now())
+	if config.Serve.RunOnStart {
+		next = time.Now()
+	}
+	for {
+		at := next
+		if config.Serve.JitterSeconds > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(config.Serve.JitterSeconds)+1)) * time.Second)
+		}
+		logger.Info("next run scheduled", "at", at.Format(time.RFC3339))
+		if !sleepUntil(ctx, at) {
+			break
+		}
+
+		started := time.Now()
+		if lock, err := acquireRunLock("serve"); err != nil {
+			if isLockHeld(err) {
+				logger.Warn("scheduled run skipped: " + err.Error())
+			} else {
+				logger.Error("scheduled run skipped, failed to acquire lock", "error", err)
+			}
+		} else {
+			runArchive(ctx)
+			lock.Release()
+			code = runExitCode(false)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// Runs never overlap: slots that passed while this run was busy are skipped
+		next = sched.Next(time.Now())
+		if missed := sched.Next(started); missed.Before(time.Now()) {
+			logger.Warn("run took longer than the schedule interval, skipped missed runs",
+				"started", started.Format(time.RFC3339), "missed", missed.Format(time.RFC3339))
+		}
+	}
+	logger.Info("serve stopped", "exit_code", code)
+	return code
+}
+
+// sleepUntil waits until t or until ctx is cancelled, reporting whether t was reached. It wakes up every
+// minute so that wall clock changes and sleep/resume do not delay a run.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	for {
+		d := time.Until(t)
+		if d <= 0 {
+			return true
+		}
+		if d > time.Minute {
+			d = time.Minute
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpPartSuffix is appended to the remote name while a file is being transferred
+const sftpPartSuffix = ".part"
+
+// SFTPConfig describes an SFTP server archives are delivered to
+type SFTPConfig struct {
+	Host                  string `json:"host"`                     // required
+	Port                  int    `json:"port"`                     // default 22
+	User                  string `json:"user"`                     // required
+	Password              string `json:"password"`                 // password or keyboard-interactive auth
+	PrivateKeyFile        string `json:"private_key_file"`         // OpenSSH or PEM private key
+	PrivateKeyPassphrase  string `json:"private_key_passphrase"`   // for encrypted keys
+	KnownHostsFile        string `json:"known_hosts_file"`         // defaults to ~/.ssh/known_hosts
+	InsecureIgnoreHostKey bool   `json:"insecure_ignore_host_key"` // only for testing
+	RemoteDir             string `json:"remote_dir"`               // folder template, e.g. "/incoming/%h/%Y/%m"
+	RetentionDays         int    `json:"retention_days"`           // remove remote archives older than this; 0 keeps everything
+	TimeoutSeconds        int    `json:"timeout_seconds"`          // connection timeout, default 30
+}
+
+// sftpTarget uploads files over SFTP. The connection is opened on first use and shared by all uploads.
+type sftpTarget struct {
+	name      string
+	cfg       SFTPConfig
+	addr      string
+	sshConfig *ssh.ClientConfig
+
+	mu      sync.Mutex
+	current *sftpConn // connection handed to new uploads, nil until the next dial
+}
+
+// sftpConn is an SSH connection with its SFTP session. A connection that failed an upload is retired: new
+// uploads dial a fresh one, and the old one is closed once the uploads still using it have finished.
+type sftpConn struct {
+	conn    *ssh.Client
+	client  *sftp.Client
+	users   int
+	retired bool
+}
+
+// newSFTPTarget validates the settings of an SFTP target and loads its key and known hosts
+func newSFTPTarget(name string, cfg SFTPConfig) (*sftpTarget, error) {
+	if cfg.Host == "" || cfg.User == "" {
+		return nil, fmt.Errorf("sftp.host and sftp.user are required")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 22
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 30
+	}
+	if cfg.RetentionDays > 0 && !strings.Contains(cfg.RemoteDir, "%h") {
+		// Without the host name in the path, retention would remove the uploads of other servers
+		return nil, fmt.Errorf("sftp.retention_days needs %%h in sftp.remote_dir, so that only this host's files are removed")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("sftp.private_key_file: %v", err)
+		}
+		var signer ssh.Signer
+		if cfg.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cfg.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sftp.private_key_file: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		password := cfg.Password
+		auth = append(auth, ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp needs password or private_key_file")
+	}
+
+	var hostKey ssh.HostKeyCallback
+	if cfg.InsecureIgnoreHostKey {
+		hostKey = ssh.InsecureIgnoreHostKey()
+	} else {
+		if cfg.KnownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("sftp.known_hosts_file is not set and the home folder is unknown: %v", err)
+			}
+			cfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		cb, err := knownhosts.New(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("sftp.known_hosts_file: %v", err)
+		}
+		hostKey = cb
+	}
+
+	return &sftpTarget{
+		name: name,
+		cfg:  cfg,
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		sshConfig: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         time.Duration(cfg.TimeoutSeconds) * time.Second,
+		},
+	}, nil
+}
+
+// Name returns the configured target name
+func (t *sftpTarget) Name() string {
+	return t.name
+}
+
+// acquire returns the shared connection, dialling the server if needed. Every acquire is paired with a release.
+func (t *sftpTarget) acquire() (*sftpConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		conn, err := ssh.Dial("tcp", t.addr, t.sshConfig)
+		if err != nil {
+			return nil, err
+		}
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		t.current = &sftpConn{conn: conn, client: client}
+	}
+	t.current.users++
+	return t.current, nil
+}
+
+// release gives back a connection. With failed set the connection is retired, so the retry of the failed
+// upload reconnects while the other uploads finish on the connection they have.
+func (t *sftpTarget) release(c *sftpConn, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.users--
+	if failed {
+		t.retire(c)
+	}
+	if c.retired && c.users == 0 {
+		_ = c.client.Close()
+		_ = c.conn.Close()
+	}
+}
+
+// retire stops handing out c to new uploads; the caller holds t.mu
+func (t *sftpTarget) retire(c *sftpConn) {
+	c.retired = true
+	if t.current == c {
+		t.current = nil
+	}
+}
+
+// Close drops the connection once the uploads using it have finished; the next upload reconnects
+func (t *sftpTarget) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.current
+	if c == nil {
+		return nil
+	}
+	t.retire(c)
+	if c.users > 0 {
+		return nil
+	}
+	_ = c.client.Close()
+	return c.conn.Close()
+}
+
+// Upload copies a file to "<remote_dir>/<name>.part" and renames it into place once the remote size matches.
+// A transfer that fails part-way is resumed from the size of the .part file, on reconnect or in a later run,
+// as long as the .part file is newer than the local file. A resumed file is only renamed into place when its
+// SHA-256 matches the checksum sidecar of the local file; otherwise it is uploaded again from the start.
+func (t *sftpTarget) Upload(ctx context.Context, u remoteUpload) (string, error) {
+	dir := path.Clean(expandRemotePrefix(t.cfg.RemoteDir, u))
+	remote := path.Join(dir, u.Name)
+	location := fmt.Sprintf("sftp://%s@%s%s", t.cfg.User, t.addr, remote)
+	if !path.IsAbs(remote) {
+		location = fmt.Sprintf("sftp://%s@%s/~/%s", t.cfg.User, t.addr, remote)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= 3; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, time.Duration(attempt-1)*2*time.Second); err != nil {
+				return location, err
+			}
+		}
+		if lastErr = t.uploadOnce(ctx, u.LocalPath, dir, remote); lastErr == nil {
+			return location, nil
+		}
+		if ctx.Err() != nil {
+			// The .part file stays on the server so the next run resumes it
+			return location, ctx.Err()
+		}
+	}
+	return location, lastErr
+}
+
+// uploadOnce makes one upload attempt; a failed attempt retires the connection it used
+func (t *sftpTarget) uploadOnce(ctx context.Context, localPath, dir, remote string) (err error) {
+	c, err := t.acquire()
+	if err != nil {
+		return err
+	}
+	defer func() { t.release(c, err != nil) }()
+	client := c.client
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if dir != "." {
+		if err := client.MkdirAll(dir); err != nil {
+			return fmt.Errorf("create %s: %v", dir, err)
+		}
+	}
+	part := remote + sftpPartSuffix
+	var offset int64
+	if st, err := client.Stat(part); err == nil && st.Size() <= size && st.ModTime().After(info.ModTime()) {
+		offset = st.Size()
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	dst, err := client.OpenFile(part, flags)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", part, err)
+	}
+	if offset > 0 {
+		logger.Info("resuming upload", pathAttr(localPath), "target", t.name, "offset", offset, "bytes", size)
+		if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+			_ = dst.Close()
+			return err
+		}
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			_ = dst.Close()
+			return err
+		}
+	}
+	_, err = io.Copy(dst, &contextReader{ctx: ctx, r: src})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %v", part, err)
+	}
+
+	st, err := client.Stat(part)
+	if err != nil {
+		return fmt.Errorf("stat %s: %v", part, err)
+	}
+	if st.Size() != size {
+		_ = client.Remove(part)
+		return fmt.Errorf("remote size %d, local size %d", st.Size(), size)
+	}
+	if offset > 0 {
+		// The start of the file was written by an earlier attempt, possibly of a different file of the same size
+		want, err := readChecksumSidecar(localPath)
+		if err != nil {
+			if want, err = fileSHA256(localPath); err != nil {
+				return err
+			}
+		}
+		got, err := remoteSHA256(ctx, client, part)
+		if err != nil {
+			return fmt.Errorf("checksum %s: %v", part, err)
+		}
+		if got != want {
+			_ = client.Remove(part)
+			return fmt.Errorf("resumed %s does not match the local checksum, uploading it again", part)
+		}
+	}
+	// posix-rename replaces an existing file atomically; plain SFTP rename fails if the target exists
+	if err := client.PosixRename(part, remote); err != nil {
+		_ = client.Remove(remote)
+		if err := client.Rename(part, remote); err != nil {
+			return fmt.Errorf("rename %s: %v", part, err)
+		}
+	}
+	return nil
+}
+
+// remoteSHA256 returns the hex encoded SHA-256 digest of a remote file
+func remoteSHA256(ctx context.Context, client *sftp.Client, name string) (string, error) {
+	f, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sftpRetentionScope returns the folder retention walks, the fixed part of remote_dir before the first
+// placeholder, and a pattern matching the folders remote_dir expands to for this host
+func sftpRetentionScope(remoteDir, host string) (string, *regexp.Regexp) {
+	remoteDir = path.Clean(remoteDir)
+	root := remoteDir
+	if i := strings.Index(root, "%"); i >= 0 {
+		root = path.Dir(root[:i] + "x")
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(remoteDir); i++ {
+		if remoteDir[i] != '%' || i+1 == len(remoteDir) {
+			pattern.WriteString(regexp.QuoteMeta(remoteDir[i : i+1]))
+			continue
+		}
+		i++
+		switch remoteDir[i] {
+		case 'Y':
+			pattern.WriteString(`\d{4}`)
+		case 'y', 'm', 'd':
+			pattern.WriteString(`\d{2}`)
+		case 'g':
+			pattern.WriteString(`[^/]+`)
+		case 'h':
+			pattern.WriteString(regexp.QuoteMeta(host))
+		default:
+			pattern.WriteString(regexp.QuoteMeta(remoteDir[i-1 : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return root, regexp.MustCompile(pattern.String())
+}
+
+// Cleanup removes archives, sidecars and stale .part files older than retention_days from the folders
+// remote_dir expands to for this host; the uploads of other hosts below the same folder are left alone
+func (t *sftpTarget) Cleanup() error {
+	if t.cfg.RetentionDays <= 0 {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("host name: %v", err)
+	}
+	root, folders := sftpRetentionScope(t.cfg.RemoteDir, host)
+	c, err := t.acquire()
+	if err != nil {
+		return err
+	}
+	defer t.release(c, false)
+	client := c.client
+	cutoff := time.Now().AddDate(0, 0, -t.cfg.RetentionDays)
+	walker := client.Walk(root)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue
+		}
+		st := walker.Stat()
+		if st.IsDir() || !st.ModTime().Before(cutoff) || !isRemoteArtifact(st.Name()) ||
+			!folders.MatchString(path.Dir(walker.Path())) {
+			continue
+		}
+		if err := client.Remove(walker.Path()); err != nil {
+			logger.Warn("failed to remove old remote file", "target", t.name, "path", walker.Path(), "error", err)
+		} else {
+			logger.Info("old remote file removed", "target", t.name, "path", walker.Path(), "rule", "retention_days")
+		}
+	}
+	return nil
+}
+
+// isRemoteArtifact reports whether a remote file name is one this tool uploads
+func isRemoteArtifact(name string) bool {
+	name = strings.TrimSuffix(name, sftpPartSuffix)
+	for _, ext := range []string{checksumExtension, manifestExtension} {
+		if strings.HasSuffix(name, ext) {
+			return isArchiveFile(strings.TrimSuffix(name, ext))
+		}
+	}
+	return isArchiveFile(name)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server with the SFTP subsystem, serving the local file system
+type testSFTPServer struct {
+	addr  string
+	key   ssh.PublicKey
+	dials atomic.Int32
+}
+
+// startSFTPServer starts a server that accepts user "iislc" with password "secret"
+func startSFTPServer(t *testing.T) *testSFTPServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "iislc" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testSFTPServer{addr: ln.Addr().String(), key: signer.PublicKey()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.dials.Add(1)
+			go serveSFTPConn(conn, config)
+		}
+	}()
+	return s
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload of a subsystem request is the length-prefixed subsystem name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+			}
+		}()
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+		}()
+	}
+}
+
+// newTestSFTPTarget returns a target for the server that trusts hostKey through a known_hosts file
+func newTestSFTPTarget(t *testing.T, s *testSFTPServer, hostKey ssh.PublicKey, remoteDir string) *sftpTarget {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(s.addr)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, hostKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var portNumber int
+	fmt.Sscan(port, &portNumber)
+	target, err := newSFTPTarget("test", SFTPConfig{
+		Host:           host,
+		Port:           portNumber,
+		User:           "iislc",
+		Password:       "secret",
+		KnownHostsFile: knownHosts,
+		RemoteDir:      remoteDir,
+		TimeoutSeconds: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	return target
+}
+
+// writeTestFile creates a local file of n pseudo-random bytes
+func writeTestFile(t *testing.T, path string, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSFTPUpload(t *testing.T) {
+	s := startSFTPServer(t)
+	remoteRoot := t.TempDir()
+	target := newTestSFTPTarget(t, s, s.key, filepath.ToSlash(remoteRoot)+"/%h/%Y")
+
+	local := filepath.Join(t.TempDir(), "u_ex240501.zip")
+	data := writeTestFile(t, local, 300<<10)
+	u := remoteUpload{LocalPath: local, Name: "u_ex240501.zip", Period: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), Host: "web01"}
+	location, err := target.Upload(context.Background(), u)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	remote := filepath.Join(remoteRoot, "web01", "2024", "u_ex240501.zip")
+	if !strings.HasSuffix(location, filepath.ToSlash(remote)) {
+		t.Errorf("location %s does not end in %s", location, remote)
+	}
+	got, err := os.ReadFile(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("remote file differs from the local file")
+	}
+	if _, err := os.Stat(remote + sftpPartSuffix); !os.IsNotExist(err) {
+		t.Errorf("the .part file was not renamed: %v", err)
+	}
+}
+
+func TestSFTPHostKeyRejected(t *testing.T) {
+	s := startSFTPServer(t)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteRoot := t.TempDir()
+	target := newTestSFTPTarget(t, s, otherKey, filepath.ToSlash(remoteRoot))
+
+	local := filepath.Join(t.TempDir(), "u_ex240501.zip")
+	writeTestFile(t, local, 1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = target.Upload(ctx, remoteUpload{LocalPath: local, Name: "u_ex240501.zip"})
+	if err == nil {
+		t.Fatal("upload to a server with a different host key succeeded")
+	}
+	var keyErr *knownhosts.KeyError
+	if _, uerr := target.acquire(); uerr == nil || !errors.As(uerr, &keyErr) {
+		t.Errorf("connect error = %v, want a knownhosts.KeyError", uerr)
+	}
+	if entries, _ := os.ReadDir(remoteRoot); len(entries) != 0 {
+		t.Errorf("%d files written despite the host key mismatch", len(entries))
+	}
+}
+
+func TestSFTPResume(t *testing.T) {
+	const size = 200 << 10
+	tests := []struct {
+		name        string
+		partSize    int
+		partAge     time.Duration // how much newer the .part file is than the local file
+		partInHash  bool          // the checksum sidecar covers the content of the .part file
+		wantResumed bool
+	}{
+		{"newer part is resumed", 64 << 10, time.Hour, true, true},
+		{"part of other content is uploaded again", 64 << 10, time.Hour, false, false},
+		{"complete part of other content is uploaded again", size, time.Hour, false, false},
+		{"older part is replaced", 64 << 10, -time.Hour, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSFTPServer(t)
+			remoteRoot := t.TempDir()
+			target := newTestSFTPTarget(t, s, s.key, filepath.ToSlash(remoteRoot))
+
+			local := filepath.Join(t.TempDir(), "u_ex240501.zip")
+			data := writeTestFile(t, local, size)
+			modTime := time.Now().Add(-2 * time.Hour)
+			if err := os.Chtimes(local, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			// A partial upload left by an interrupted run. It is filled with zeros instead of the real
+			// prefix so the result shows whether the upload continued after it or started over; the
+			// sidecar of the local file decides whether the resumed content is accepted.
+			resumed := append(make([]byte, tt.partSize), data[tt.partSize:]...)
+			part := filepath.Join(remoteRoot, "u_ex240501.zip"+sftpPartSuffix)
+			if err := os.WriteFile(part, make([]byte, tt.partSize), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			partTime := modTime.Add(tt.partAge)
+			if err := os.Chtimes(part, partTime, partTime); err != nil {
+				t.Fatal(err)
+			}
+			if tt.partInHash {
+				sum := sha256.Sum256(resumed)
+				line := hex.EncodeToString(sum[:]) + "  u_ex240501.zip\n"
+				if err := os.WriteFile(local+checksumExtension, []byte(line), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := target.Upload(context.Background(), remoteUpload{LocalPath: local, Name: "u_ex240501.zip"}); err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(remoteRoot, "u_ex240501.zip"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := data
+			if tt.wantResumed {
+				want = resumed
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("remote file does not match: resumed %v, want %v", bytes.Equal(got, resumed), tt.wantResumed)
+			}
+		})
+	}
+}
+
+func TestSFTPRetentionScope(t *testing.T) {
+	tests := []struct {
+		remoteDir string
+		wantRoot  string
+		dir       string
+		want      bool
+	}{
+		{"/incoming/%h/%Y/%m", "/incoming", "/incoming/web01/2024/05", true},
+		{"/incoming/%h/%Y/%m", "/incoming", "/incoming/web02/2024/05", false},
+		{"/incoming/%h/%Y/%m", "/incoming", "/incoming/web01/2024", false},
+		{"/incoming/%Y/%h", "/incoming", "/incoming/2024/web01", true},
+		{"/incoming/%Y/%h", "/incoming", "/incoming/2024/web01.old", false},
+		{"incoming/%h-%g/", "incoming", "incoming/web01-2024-05", true},
+		{"%h", ".", "web01", true},
+		{"%h", ".", ".", false},
+	}
+	for _, tt := range tests {
+		root, folders := sftpRetentionScope(tt.remoteDir, "web01")
+		if root != tt.wantRoot {
+			t.Errorf("%s: root %q, want %q", tt.remoteDir, root, tt.wantRoot)
+		}
+		if got := folders.MatchString(tt.dir); got != tt.want {
+			t.Errorf("%s: %s matches %v, want %v", tt.remoteDir, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestSFTPCleanupKeepsOtherHosts(t *testing.T) {
+	s := startSFTPServer(t)
+	remoteRoot := t.TempDir()
+	target := newTestSFTPTarget(t, s, s.key, filepath.ToSlash(remoteRoot)+"/%h/%Y")
+	target.cfg.RetentionDays = 30
+
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, 0, -60)
+	files := map[string]bool{ // path below the remote root -> removed by retention
+		filepath.Join(host, "2024", "logs_2024-05.zip"):         true,
+		filepath.Join(host, "2024", "logs_2024-05.zip.sha256"):  true,
+		filepath.Join(host, "2024", "notes.txt"):                false,
+		filepath.Join("other-host", "2024", "logs_2024-05.zip"): false,
+		filepath.Join(host, "logs_2024-05.zip"):                 false,
+	}
+	for name := range files {
+		p := filepath.Join(remoteRoot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := target.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	for name, wantRemoved := range files {
+		_, err := os.Stat(filepath.Join(remoteRoot, name))
+		if removed := os.IsNotExist(err); removed != wantRemoved {
+			t.Errorf("%s: removed %v, want %v", name, removed, wantRemoved)
+		}
+	}
+
+	if _, err := newSFTPTarget("test", SFTPConfig{Host: "h", User: "u", Password: "p", RemoteDir: "/incoming/%Y",
+		RetentionDays: 30}); err == nil {
+		t.Error("retention_days accepted for a remote_dir without %h")
+	}
+}
+
+func TestSFTPConcurrentUploads(t *testing.T) {
+	s := startSFTPServer(t)
+	remoteRoot := t.TempDir()
+	target := newTestSFTPTarget(t, s, s.key, filepath.ToSlash(remoteRoot)+"/%h")
+	localDir := t.TempDir()
+
+	const n = 8
+	files := make([][]byte, n)
+	for i := range files {
+		files[i] = writeTestFile(t, filepath.Join(localDir, fmt.Sprintf("u_ex2405%02d.zip", i+1)), 128<<10)
+	}
+	// A regular file where the remote folder of host "blocked" should be, so its upload keeps failing
+	// while the others are in flight on the same connection
+	if err := os.WriteFile(filepath.Join(remoteRoot, "blocked"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocked := filepath.Join(localDir, "blocked.zip")
+	writeTestFile(t, blocked, 1024)
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("u_ex2405%02d.zip", i+1)
+			_, errs[i] = target.Upload(context.Background(), remoteUpload{LocalPath: filepath.Join(localDir, name), Name: name, Host: "web01"})
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := target.Upload(ctx, remoteUpload{LocalPath: blocked, Name: "blocked.zip", Host: "blocked"}); err == nil {
+			t.Error("upload into a file instead of a folder succeeded")
+		}
+	}()
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("upload %d: %v", i+1, err)
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(remoteRoot, "web01", fmt.Sprintf("u_ex2405%02d.zip", i+1)))
+		if err != nil || !bytes.Equal(got, files[i]) {
+			t.Errorf("upload %d: remote file differs (%v)", i+1, err)
+		}
+	}
+}
+
+func TestSFTPFailedAttemptKeepsOtherUploads(t *testing.T) {
+	s := startSFTPServer(t)
+	target := newTestSFTPTarget(t, s, s.key, filepath.ToSlash(t.TempDir()))
+
+	// Two uploads share the connection and the first one fails
+	a, err := target.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := target.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("concurrent uploads do not share the connection")
+	}
+	target.release(a, true)
+
+	// The other upload can still use the connection, while the retry gets a new one
+	if _, err := b.client.Getwd(); err != nil {
+		t.Errorf("connection closed under the other upload: %v", err)
+	}
+	c, err := target.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == b {
+		t.Error("the retry got the connection of the failed attempt")
+	}
+	if got := s.dials.Load(); got != 2 {
+		t.Errorf("%d connections, want 2", got)
+	}
+
+	// The retired connection is closed when its last upload finishes
+	target.release(b, false)
+	if _, err := b.client.Getwd(); err == nil {
+		t.Error("retired connection still open after its last upload finished")
+	}
+	target.release(c, false)
+	if _, err := c.client.Getwd(); err != nil {
+		t.Errorf("current connection closed: %v", err)
+	}
+}
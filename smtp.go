@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateEmailConfig normalises the email settings and loads the templates when email is enabled
+func validateEmailConfig(e *EmailConfig) error {
+	e.TLSMode = strings.ToLower(strings.TrimSpace(e.TLSMode))
+	switch e.TLSMode {
+	case "":
+		e.TLSMode = "auto"
+	case "auto", "implicit", "starttls", "none":
+	default:
+		return fmt.Errorf("email_notification.tls_mode must be \"auto\", \"implicit\", \"starttls\" or \"none\", got %q", e.TLSMode)
+	}
+	e.AuthMechanism = strings.ToLower(strings.TrimSpace(e.AuthMechanism))
+	switch e.AuthMechanism {
+	case "":
+		e.AuthMechanism = "plain"
+	case "plain", "login":
+	default:
+		return fmt.Errorf("email_notification.auth_mechanism must be \"plain\" or \"login\", got %q", e.AuthMechanism)
+	}
+	if e.SMTPPort <= 0 {
+		switch e.TLSMode {
+		case "implicit":
+			e.SMTPPort = 465
+		case "none":
+			e.SMTPPort = 25
+		default:
+			e.SMTPPort = 587
+		}
+	}
+	if e.TLSMode == "auto" && e.SMTPPort == 465 {
+		e.TLSMode = "implicit"
+	}
+	if e.DialTimeoutSeconds <= 0 {
+		e.DialTimeoutSeconds = 10
+	}
+	if e.TimeoutSeconds <= 0 {
+		e.TimeoutSeconds = 60
+	}
+	if e.Enabled && e.SMTPHost == "" {
+		return fmt.Errorf("email_notification.smtp_host is required")
+	}
+	if e.MaxAttachmentMB <= 0 {
+		e.MaxAttachmentMB = 10
+	}
+	if err := validateEmailRouting(e); err != nil {
+		return err
+	}
+	if !e.Enabled {
+		return nil
+	}
+	return loadEmailTemplates(*e)
+}
+
+// smtpTLSConfig builds the TLS settings for the SMTP connection, adding ca_file to the system roots
+func smtpTLSConfig(e EmailConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         e.SMTPHost,
+		InsecureSkipVerify: e.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if e.TLSServerName != "" {
+		tc.ServerName = e.TLSServerName
+	}
+	if e.CAFile != "" {
+		pem, err := os.ReadFile(e.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s: no PEM certificates found", e.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
+
+// sendMail delivers msg over SMTP. The whole conversation is bounded by timeout_seconds so a hung server
+// cannot block the run; authentication is only attempted when a username is set.
+func sendMail(ctx context.Context, e EmailConfig, from string, rcpts []string, msg []byte) error {
+	tc, err := smtpTLSConfig(e)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(e.SMTPHost, strconv.Itoa(e.SMTPPort))
+	dialer := &net.Dialer{Timeout: time.Duration(e.DialTimeoutSeconds) * time.Second}
+
+	var conn net.Conn
+	if e.TLSMode == "implicit" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tc}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connect %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(e.TimeoutSeconds) * time.Second))
+
+	c, err := smtp.NewClient(conn, e.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp greeting: %v", err)
+	}
+	defer c.Close()
+
+	if e.HeloName != "" {
+		if err := c.Hello(e.HeloName); err != nil {
+			return fmt.Errorf("smtp EHLO: %v", err)
+		}
+	}
+	secure := e.TLSMode == "implicit"
+	if e.TLSMode == "auto" || e.TLSMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tc); err != nil {
+				return fmt.Errorf("smtp STARTTLS: %v", err)
+			}
+			secure = true
+		} else if e.TLSMode == "starttls" {
+			return errors.New("smtp server does not offer STARTTLS and tls_mode is \"starttls\"")
+		}
+	}
+
+	if e.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support AUTH; remove username for an unauthenticated relay")
+		}
+		if !secure && !e.AllowInsecureAuth {
+			return errors.New("refusing to send credentials over an unencrypted connection; enable TLS or set allow_insecure_auth")
+		}
+		var auth smtp.Auth = &plainAuth{username: e.Username, password: e.Password}
+		if e.AuthMechanism == "login" {
+			auth = &loginAuth{username: e.Username, password: e.Password}
+		}
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp AUTH: %v", err)
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("smtp MAIL FROM: %v", err)
+	}
+	for _, r := range rcpts {
+		if err := c.Rcpt(r); err != nil {
+			return fmt.Errorf("smtp RCPT TO %s: %v", r, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp DATA: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp DATA: %v", err)
+	}
+	return c.Quit()
+}
+
+// plainAuth is AUTH PLAIN without the TLS check of smtp.PlainAuth; sendMail decides when credentials may be sent
+type plainAuth struct {
+	username, password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+// loginAuth is AUTH LOGIN, still required by some Exchange and Office 365 setups
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
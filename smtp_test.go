@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer is a minimal SMTP server for one test. It records what the client did and can be told to
+// stall at the TLS handshake or after the greeting.
+type fakeSMTPServer struct {
+	ln       net.Listener
+	tls      *tls.Config
+	implicit bool   // TLS from the first byte instead of STARTTLS
+	starttls bool   // offer STARTTLS
+	stall    string // "handshake" or "greeting" to stop answering at that point
+
+	mu       sync.Mutex
+	secure   bool
+	authMech string
+	authUser string
+	authPass string
+	from     string
+	rcpts    []string
+	data     string
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and the path of its PEM file
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iislc test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"mail.test"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// start listens on a random local port and returns the email settings pointing at it
+func (s *fakeSMTPServer) start(t *testing.T) EmailConfig {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	return EmailConfig{SMTPHost: "127.0.0.1", SMTPPort: port, DialTimeoutSeconds: 5, TimeoutSeconds: 5, AuthMechanism: "plain"}
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if s.stall == "handshake" {
+		// Accept the connection but never answer the TLS handshake
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+	if s.implicit {
+		tc := tls.Server(conn, s.tls)
+		if tc.Handshake() != nil {
+			return
+		}
+		conn = tc
+		s.setSecure()
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+	reply("220 fake ESMTP")
+	if s.stall == "greeting" {
+		_, _ = io.Copy(io.Discard, r)
+		return
+	}
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			s.mu.Lock()
+			secure := s.secure
+			s.mu.Unlock()
+			reply("250-fake greets " + arg)
+			if s.starttls && !secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn = tc
+			r = bufio.NewReader(conn)
+			s.setSecure()
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			var user, pass string
+			switch strings.ToUpper(mech) {
+			case "PLAIN":
+				if initial == "" {
+					reply("334 ")
+					initial, _ = readLine()
+				}
+				dec, _ := base64.StdEncoding.DecodeString(initial)
+				parts := strings.Split(string(dec), "\x00")
+				if len(parts) == 3 {
+					user, pass = parts[1], parts[2]
+				}
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				line, _ := readLine()
+				dec, _ := base64.StdEncoding.DecodeString(line)
+				user = string(dec)
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				line, _ = readLine()
+				dec, _ = base64.StdEncoding.DecodeString(line)
+				pass = string(dec)
+			}
+			s.mu.Lock()
+			s.authMech, s.authUser, s.authPass = strings.ToUpper(mech), user, pass
+			s.mu.Unlock()
+			if user == "alice" && pass == "pa55" {
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			s.mu.Lock()
+			s.from = arg
+			s.mu.Unlock()
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, arg)
+			s.mu.Unlock()
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var b strings.Builder
+			for {
+				line, ok := readLine()
+				if !ok || line == "." {
+					break
+				}
+				b.WriteString(line + "\n")
+			}
+			s.mu.Lock()
+			s.data = b.String()
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) setSecure() {
+	s.mu.Lock()
+	s.secure = true
+	s.mu.Unlock()
+}
+
+func TestSendMail(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tests := []struct {
+		name       string
+		server     *fakeSMTPServer
+		configure  func(e *EmailConfig)
+		wantErr    string // substring of the expected error; empty for success
+		wantSecure bool
+		wantAuth   string // mechanism the server saw; empty for none
+	}{
+		{
+			name:       "starttls with auth plain",
+			server:     &fakeSMTPServer{starttls: true},
+			configure:  func(e *EmailConfig) { e.TLSMode = "starttls"; e.Username, e.Password = "alice", "pa55" },
+			wantSecure: true,
+			wantAuth:   "PLAIN",
+		},
+		{
+			name:   "auto upgrades with starttls and auth login",
+			server: &fakeSMTPServer{starttls: true},
+			configure: func(e *EmailConfig) {
+				e.TLSMode = "auto"
+				e.Username, e.Password, e.AuthMechanism = "alice", "pa55", "login"
+			},
+			wantSecure: true,
+			wantAuth:   "LOGIN",
+		},
+		{
+			name:   "implicit tls with auth login",
+			server: &fakeSMTPServer{implicit: true},
+			configure: func(e *EmailConfig) {
+				e.TLSMode = "implicit"
+				e.Username, e.Password, e.AuthMechanism = "alice", "pa55", "login"
+			},
+			wantSecure: true,
+			wantAuth:   "LOGIN",
+		},
+		{
+			name:      "auto without starttls sends plain relay mail",
+			server:    &fakeSMTPServer{},
+			configure: func(e *EmailConfig) { e.TLSMode = "auto" },
+		},
+		{
+			name:      "starttls required but not offered",
+			server:    &fakeSMTPServer{},
+			configure: func(e *EmailConfig) { e.TLSMode = "starttls" },
+			wantErr:   "does not offer STARTTLS",
+		},
+		{
+			name:      "no credentials over plain text",
+			server:    &fakeSMTPServer{},
+			configure: func(e *EmailConfig) { e.TLSMode = "none"; e.Username, e.Password = "alice", "pa55" },
+			wantErr:   "refusing to send credentials",
+		},
+		{
+			name:   "allow_insecure_auth sends credentials over plain text",
+			server: &fakeSMTPServer{},
+			configure: func(e *EmailConfig) {
+				e.TLSMode = "none"
+				e.Username, e.Password, e.AllowInsecureAuth = "alice", "pa55", true
+			},
+			wantAuth: "PLAIN",
+		},
+		{
+			name:       "wrong password",
+			server:     &fakeSMTPServer{starttls: true},
+			configure:  func(e *EmailConfig) { e.TLSMode = "starttls"; e.Username, e.Password = "alice", "wrong" },
+			wantErr:    "smtp AUTH",
+			wantSecure: true,
+			wantAuth:   "PLAIN",
+		},
+		{
+			name:      "untrusted certificate",
+			server:    &fakeSMTPServer{starttls: true},
+			configure: func(e *EmailConfig) { e.TLSMode = "starttls"; e.CAFile = "" },
+			wantErr:   "smtp STARTTLS",
+		},
+		{
+			name:       "tls_server_name",
+			server:     &fakeSMTPServer{implicit: true},
+			configure:  func(e *EmailConfig) { e.TLSMode = "implicit"; e.TLSServerName = "mail.test" },
+			wantSecure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			s.tls = tlsConfig
+			e := s.start(t)
+			e.CAFile = caFile
+			tt.configure(&e)
+
+			msg := "Subject: test\r\n\r\nhello\r\n"
+			err := sendMail(context.Background(), e, "iislc@example.com", []string{"ops@example.com", "dev@example.com"}, []byte(msg))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.secure != tt.wantSecure {
+				t.Errorf("TLS = %v, want %v", s.secure, tt.wantSecure)
+			}
+			if s.authMech != tt.wantAuth {
+				t.Errorf("AUTH mechanism = %q, want %q", s.authMech, tt.wantAuth)
+			}
+			if tt.wantAuth != "" && (s.authUser != "alice" || s.authPass != e.Password) {
+				t.Errorf("credentials = %q/%q", s.authUser, s.authPass)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if s.from != "FROM:<iislc@example.com>" {
+				t.Errorf("MAIL %s", s.from)
+			}
+			if len(s.rcpts) != 2 || s.rcpts[1] != "TO:<dev@example.com>" {
+				t.Errorf("RCPT %v", s.rcpts)
+			}
+			if !strings.Contains(s.data, "hello") {
+				t.Errorf("DATA %q does not contain the message", s.data)
+			}
+		})
+	}
+}
+
+func TestSendMailTimeouts(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	tests := []struct {
+		name        string
+		server      *fakeSMTPServer
+		mode        string
+		dialTimeout int
+		timeout     int
+		wantErr     string
+	}{
+		// dial_timeout_seconds also bounds the implicit TLS handshake
+		{"dial timeout", &fakeSMTPServer{implicit: true, stall: "handshake"}, "implicit", 1, 30, "connect"},
+		// timeout_seconds bounds the conversation after the greeting
+		{"command timeout", &fakeSMTPServer{stall: "greeting"}, "auto", 30, 1, "smtp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+			e := s.start(t)
+			e.TLSMode = tt.mode
+			e.InsecureSkipVerify = true
+			e.DialTimeoutSeconds, e.TimeoutSeconds = tt.dialTimeout, tt.timeout
+
+			start := time.Now()
+			err := sendMail(context.Background(), e, "iislc@example.com", []string{"ops@example.com"}, []byte("hello\r\n"))
+			elapsed := time.Since(start)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one starting with %q", err, tt.wantErr)
+			}
+			if elapsed < 900*time.Millisecond || elapsed > 5*time.Second {
+				t.Errorf("gave up after %v, want about 1s", elapsed)
+			}
+		})
+	}
+}
+
+func TestValidateEmailConfigPorts(t *testing.T) {
+	tests := []struct {
+		mode     string
+		port     int
+		wantMode string
+		wantPort int
+	}{
+		{"", 0, "auto", 587},
+		{"implicit", 0, "implicit", 465},
+		{"none", 0, "none", 25},
+		{"starttls", 0, "starttls", 587},
+		{"auto", 465, "implicit", 465},
+		{"AUTO", 2525, "auto", 2525},
+	}
+	for _, tt := range tests {
+		e := EmailConfig{TLSMode: tt.mode, SMTPPort: tt.port}
+		if err := validateEmailConfig(&e); err != nil {
+			t.Fatalf("tls_mode %q: %v", tt.mode, err)
+		}
+		if e.TLSMode != tt.wantMode || e.SMTPPort != tt.wantPort {
+			t.Errorf("tls_mode %q port %d: got %s:%d, want %s:%d", tt.mode, tt.port, e.TLSMode, e.SMTPPort, tt.wantMode, tt.wantPort)
+		}
+	}
+	if err := validateEmailConfig(&EmailConfig{TLSMode: "ssl"}); err == nil {
+		t.Error("tls_mode \"ssl\" accepted")
+	}
+	if err := validateEmailConfig(&EmailConfig{AuthMechanism: "cram-md5"}); err == nil {
+		t.Error("auth_mechanism \"cram-md5\" accepted")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunSummary is the serialisable outcome of a run, shared by the notification channels
+type RunSummary struct {
+	Tool             string          `json:"tool"`
+	Host             string          `json:"host"`
+	Status           string          `json:"status"` // "success", "warnings", "failed" or "cancelled"
+	StartTime        time.Time       `json:"start_time"`
+	EndTime          time.Time       `json:"end_time"`
+	DurationSeconds  float64         `json:"duration_seconds"`
+	Groups           int             `json:"groups"`
+	FilesProcessed   int             `json:"files_processed"`
+	FilesCompressed  int             `json:"files_compressed"`
+	BytesBefore      int64           `json:"bytes_before"`
+	BytesAfter       int64           `json:"bytes_after"`
+	CompressionRatio float64         `json:"compression_ratio_percent"`
+	Errors           []string        `json:"errors"`
+	Warnings         []string        `json:"warnings"`
+	Uploads          []UploadSummary `json:"uploads,omitempty"`
+	Traffic          *TrafficSummary `json:"traffic,omitempty"`
+}
+
+// UploadSummary is the serialisable form of an UploadResult
+type UploadSummary struct {
+	Target     string `json:"target"`
+	File       string `json:"file"`
+	Location   string `json:"location"`
+	Bytes      int64  `json:"bytes"`
+	DurationMs int64  `json:"duration_ms"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+}
+
+// addError records an error of the run under a stable code (see README.txt); group and path may be empty
+func addError(code, group, path, msg string) {
+	logger.Error(msg, issueAttrs(code, group, path)...)
+	mu.Lock()
+	stats.Errors = append(stats.Errors, msg)
+	stats.Issues = append(stats.Issues, RunIssue{Level: "error", Code: code, Group: group, Path: path, Message: msg})
+	mu.Unlock()
+}
+
+// addWarning logs and records a problem that did not affect the archives, such as an original file that
+// could not be removed; warnings turn a successful run into "warnings" but not "failed"
+func addWarning(code, path, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Warn(msg, issueAttrs(code, "", path)...)
+	mu.Lock()
+	stats.Warnings = append(stats.Warnings, msg)
+	stats.Issues = append(stats.Issues, RunIssue{Level: "warning", Code: code, Path: path, Message: msg})
+	mu.Unlock()
+}
+
+// issueAttrs are the log fields of an error or warning
+func issueAttrs(code, group, path string) []any {
+	attrs := []any{"code", code}
+	if group != "" {
+		attrs = append(attrs, "group", group)
+	}
+	if path != "" {
+		attrs = append(attrs, pathAttr(path))
+	}
+	return attrs
+}
+
+// runStatus returns "cancelled", "success", "warnings" or "failed" for the current stats. An interrupted
+// run is "cancelled" whatever happened before the interruption.
+func runStatus() string {
+	if stats.Cancelled {
+		return "cancelled"
+	}
+	if len(stats.Errors) > 0 {
+		return "failed"
+	}
+	if len(stats.Warnings) > 0 {
+		return "warnings"
+	}
+	return "success"
+}
+
+// runExitCode maps the outcome of the run to the process exit code. A run that found no group to archive
+// is "nothing to do" unless it recorded errors or warnings.
+func runExitCode(failOnWarnings bool) int {
+	switch runStatus() {
+	case "cancelled":
+		return exitCancelled
+	case "failed":
+		return exitFailed
+	case "warnings":
+		if failOnWarnings {
+			return exitFailed
+		}
+		return exitWarnings
+	}
+	if stats.GroupCount == 0 {
+		return exitNothingToDo
+	}
+	return exitSuccess
+}
+
+// newRunSummary captures the current stats
+func newRunSummary() *RunSummary {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown-host"
+	}
+	s := &RunSummary{
+		Tool:            toolName,
+		Host:            host,
+		Status:          runStatus(),
+		StartTime:       stats.StartTime,
+		EndTime:         stats.EndTime,
+		DurationSeconds: stats.EndTime.Sub(stats.StartTime).Seconds(),
+		Groups:          stats.GroupCount,
+		FilesProcessed:  stats.FilesProcessed,
+		FilesCompressed: stats.FilesCompressed,
+		BytesBefore:     stats.TotalSizeBefore,
+		BytesAfter:      stats.TotalSizeAfter,
+		Errors:          append([]string{}, stats.Errors...),
+		Warnings:        append([]string{}, stats.Warnings...),
+	}
+	if stats.TotalSizeBefore > 0 {
+		s.CompressionRatio = float64(stats.TotalSizeBefore-stats.TotalSizeAfter) / float64(stats.TotalSizeBefore) * 100
+	}
+	for _, u := range stats.Uploads {
+		s.Uploads = append(s.Uploads, UploadSummary{
+			Target:     u.Target,
+			File:       filepath.Base(u.File),
+			Location:   u.Location,
+			Bytes:      u.Size,
+			DurationMs: u.Duration.Milliseconds(),
+			OK:         u.Err == "",
+			Error:      u.Err,
+		})
+	}
+	if stats.Traffic != nil {
+		s.Traffic = stats.Traffic.Summary()
+	}
+	return s
+}
+
+// summaryFact is a labelled value shown by the chat notification formats
+type summaryFact struct {
+	Title string
+	Value string
+}
+
+// facts lists the key figures of a run in display order
+func (s *RunSummary) facts() []summaryFact {
+	facts := []summaryFact{
+		{"Groups", fmt.Sprintf("%d", s.Groups)},
+		{"Files processed", fmt.Sprintf("%d", s.FilesProcessed)},
+		{"Files compressed", fmt.Sprintf("%d", s.FilesCompressed)},
+		{"Total before", fmt.Sprintf("%.2f MB", float64(s.BytesBefore)/(1024*1024))},
+		{"Total after", fmt.Sprintf("%.2f MB", float64(s.BytesAfter)/(1024*1024))},
+		{"Compression ratio", fmt.Sprintf("%.2f%%", s.CompressionRatio)},
+		{"Duration", (time.Duration(s.DurationSeconds * float64(time.Second))).Round(time.Millisecond).String()},
+	}
+	if s.Traffic != nil {
+		facts = append(facts, summaryFact{"Requests", fmt.Sprintf("%d (%s)", s.Traffic.Requests, s.Traffic.StatusClasses())})
+	}
+	if len(s.Uploads) > 0 {
+		failed := 0
+		for _, u := range s.Uploads {
+			if !u.OK {
+				failed++
+			}
+		}
+		facts = append(facts, summaryFact{"Uploads", fmt.Sprintf("%d succeeded, %d failed", len(s.Uploads)-failed, failed)})
+	}
+	facts = append(facts, summaryFact{"Errors / warnings", fmt.Sprintf("%d / %d", len(s.Errors), len(s.Warnings))})
+	return facts
+}
+
+// title is the one-line headline used as chat heading, e.g. "Success - IIS backup web01"
+func (s *RunSummary) title() string {
+	return fmt.Sprintf("%s - IIS backup %s", statusLabel(s.Status), s.Host)
+}
+
+// statusLabel is the capitalised run status used in subjects and headings
+func statusLabel(status string) string {
+	switch status {
+	case "failed":
+		return "Failed"
+	case "warnings":
+		return "Warnings"
+	case "cancelled":
+		return "Cancelled"
+	}
+	return "Success"
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const checksumExtension = ".sha256"
+
+// VerifyResult holds the outcome of checking a single archive
+type VerifyResult struct {
+	Path            string
+	Entries         int
+	Passed          bool
+	MissingChecksum bool
+	Problems        []string
+}
+
+// writeChecksumSidecar writes "<hex>  <name>" next to the archive, compatible with sha256sum -c
+func writeChecksumSidecar(archivePath string) error {
+	sum, err := fileSHA256(archivePath)
+	if err != nil {
+		return fmt.Errorf("checksum %s: %v", archivePath, err)
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(archivePath))
+	if err := os.WriteFile(archivePath+checksumExtension, []byte(line), 0644); err != nil {
+		return fmt.Errorf("write checksum sidecar for %s: %v", archivePath, err)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readChecksumSidecar returns the digest recorded in the archive's sidecar file
+func readChecksumSidecar(archivePath string) (string, error) {
+	f, err := os.Open(archivePath + checksumExtension)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("empty checksum file")
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("malformed checksum file")
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// isArchiveFile reports whether name looks like an archive produced by this tool
+func isArchiveFile(name string) bool {
+	return archiveKind(name) != ""
+}
+
+// archiveSidecars lists the companion files that belong to an archive
+func archiveSidecars(archivePath string) []string {
+	return []string{archivePath + checksumExtension, archivePath + manifestExtension}
+}
+
+// removeArchive deletes an archive together with its sidecar files
+func removeArchive(archivePath string) error {
+	if err := os.Remove(archivePath); err != nil {
+		return err
+	}
+	for _, s := range archiveSidecars(archivePath) {
+		if err := os.Remove(s); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove sidecar", "archive", archivePath, "path", s, "error", err)
+		}
+	}
+	return nil
+}
+
+// findArchives walks dest_folder and returns every archive found, sorted by path. NDJSON exports are
+// left out: they hold the same records as the archives and have no entries to verify, search or extract.
+func findArchives(root string) ([]string, error) {
+	var archives []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if isArchiveFile(info.Name()) && !isNDJSONFile(info.Name()) {
+			archives = append(archives, path)
+		}
+		return nil
+	})
+	sort.Strings(archives)
+	return archives, err
+}
+
+// verifyArchive reads every entry of the archive, relying on the CRC checks of the readers,
+// and compares the whole file against its checksum sidecar
+func verifyArchive(path string) VerifyResult {
+	res := VerifyResult{Path: path, Passed: true}
+	fail := func(format string, args ...interface{}) {
+		res.Passed = false
+		res.Problems = append(res.Problems, fmt.Sprintf(format, args...))
+	}
+
+	err := forEachArchiveEntry(path, func(e archiveEntry) error {
+		res.Entries++
+		rc, err := e.Open()
+		if err != nil {
+			fail("entry %s: %v", e.Name, err)
+			return nil
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			fail("entry %s: %v", e.Name, err)
+		}
+		_ = rc.Close()
+		return nil
+	})
+	if err != nil {
+		fail("open archive: %v", err)
+	}
+	checkChecksumSidecar(&res, path)
+	return res
+}
+
+// verifyParquet reads every row of a Parquet file and compares the file against its checksum sidecar.
+// Entries counts the rows.
+func verifyParquet(path string) VerifyResult {
+	res := VerifyResult{Path: path, Passed: true}
+	if err := readParquetRows(path, func(rows []parquetRow) { res.Entries += len(rows) }); err != nil {
+		res.Passed = false
+		res.Problems = append(res.Problems, fmt.Sprintf("read parquet: %v", err))
+	}
+	checkChecksumSidecar(&res, path)
+	return res
+}
+
+// checkChecksumSidecar compares the whole file against its checksum sidecar and records the outcome in res
+func checkChecksumSidecar(res *VerifyResult, path string) {
+	want, err := readChecksumSidecar(path)
+	if os.IsNotExist(err) {
+		res.MissingChecksum = true
+		return
+	}
+	problem := ""
+	if err != nil {
+		problem = fmt.Sprintf("read checksum sidecar: %v", err)
+	} else if got, err := fileSHA256(path); err != nil {
+		problem = fmt.Sprintf("compute checksum: %v", err)
+	} else if got != want {
+		problem = fmt.Sprintf("checksum mismatch: sidecar %s, actual %s", want, got)
+	}
+	if problem != "" {
+		res.Passed = false
+		res.Problems = append(res.Problems, problem)
+	}
+}
+
+// runVerify implements the verify subcommand and returns the process exit code
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the configuration file")
+	requireChecksum := fs.Bool("require-checksum", false, "fail archives that have no .sha256 sidecar")
+	_ = fs.Parse(args)
+
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		return exitInvalidConfig
+	}
+
+	archives, err := findArchives(config.DestFolder)
+	if err != nil {
+		fmt.Printf("Failed to scan %s: %v\n", config.DestFolder, err)
+		return exitFailed
+	}
+	parquetFiles, err := findParquetFiles(config.Parquet.Folder)
+	if err != nil {
+		fmt.Printf("Failed to scan %s: %v\n", config.Parquet.Folder, err)
+		return exitFailed
+	}
+	archives = append(archives, parquetFiles...)
+	if len(archives) == 0 {
+		fmt.Printf("No archives found in %s\n", config.DestFolder)
+		return exitSuccess
+	}
+
+	results := make([]VerifyResult, len(archives))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, p := range archives {
+		i, p := i, p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if isParquetFile(p) {
+				results[i] = verifyParquet(p)
+			} else {
+				results[i] = verifyArchive(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	passed, failed, missing := 0, 0, 0
+	for _, r := range results {
+		switch {
+		case !r.Passed:
+			failed++
+			fmt.Printf("FAIL %s\n", r.Path)
+			for _, p := range r.Problems {
+				fmt.Printf("  - %s\n", p)
+			}
+		case r.MissingChecksum && *requireChecksum:
+			failed++
+			missing++
+			fmt.Printf("FAIL %s\n  - no checksum sidecar\n", r.Path)
+		case r.MissingChecksum:
+			// Without the sidecar a truncated or replaced archive cannot be told apart from the original
+			missing++
+			fmt.Printf("WARN %s (%d entries, no checksum sidecar)\n", r.Path, r.Entries)
+		default:
+			passed++
+			fmt.Printf("PASS %s (%d entries)\n", r.Path, r.Entries)
+		}
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Println("VERIFY SUMMARY")
+	fmt.Println(strings.Repeat("=", 50))
+	fmt.Printf("Archives checked: %d\n", len(results))
+	fmt.Printf("Passed: %d\n", passed)
+	fmt.Printf("Failed: %d\n", failed)
+	fmt.Printf("Without checksum sidecar: %d\n", missing)
+	fmt.Println(strings.Repeat("=", 50))
+
+	if failed > 0 {
+		return exitFailed
+	}
+	if missing > 0 {
+		return exitWarnings
+	}
+	return exitSuccess
+}
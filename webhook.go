@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookMaxErrors is the number of errors or warnings listed in chat messages; the generic format has all of them
+	webhookMaxErrors = 10
+	// webhookMaxText keeps chat text blocks under the Slack and Teams size limits
+	webhookMaxText = 2900
+)
+
+// WebhookConfig describes an HTTP endpoint the run summary is posted to
+type WebhookConfig struct {
+	Name            string            `json:"name"`             // used in messages; defaults to the format
+	URL             string            `json:"url"`              // required
+	Format          string            `json:"format"`           // "slack", "teams" or "json" (default)
+	Secret          string            `json:"secret"`           // HMAC-SHA256 key; the body is signed when set
+	SignatureHeader string            `json:"signature_header"` // default X-IISLC-Signature-256, value "sha256=<hex>"
+	Headers         map[string]string `json:"headers"`          // extra request headers, e.g. Authorization
+	Attempts        int               `json:"attempts"`         // default 3
+	TimeoutSeconds  int               `json:"timeout_seconds"`  // per attempt, default 15
+}
+
+// validateWebhooks normalises the webhook settings
+func validateWebhooks(hooks []WebhookConfig) error {
+	for i := range hooks {
+		h := &hooks[i]
+		if h.URL == "" {
+			return fmt.Errorf("webhooks[%d]: url is required", i)
+		}
+		h.Format = strings.ToLower(strings.TrimSpace(h.Format))
+		switch h.Format {
+		case "":
+			h.Format = "json"
+		case "json", "slack", "teams":
+		default:
+			return fmt.Errorf("webhooks[%d]: format must be \"slack\", \"teams\" or \"json\", got %q", i, h.Format)
+		}
+		if h.Name == "" {
+			h.Name = h.Format
+		}
+		if h.SignatureHeader == "" {
+			h.SignatureHeader = "X-IISLC-Signature-256"
+		}
+		if h.Attempts <= 0 {
+			h.Attempts = 3
+		}
+		if h.TimeoutSeconds <= 0 {
+			h.TimeoutSeconds = 15
+		}
+	}
+	return nil
+}
+
+// sendWebhooks posts the run summary to every configured webhook and records the outcome
+func sendWebhooks(ctx context.Context) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+	summary := newRunSummary()
+	for _, h := range config.Webhooks {
+		if err := sendWebhook(ctx, h, summary); err != nil {
+			recordNotification("webhook", h.Name, "failed", err.Error())
+			continue
+		}
+		recordNotification("webhook", h.Name, "sent", "")
+	}
+}
+
+// sendWebhook posts the summary in the webhook's format, retrying network errors, 429 and 5xx responses
+func sendWebhook(ctx context.Context, h WebhookConfig, s *RunSummary) error {
+	var payload interface{}
+	switch h.Format {
+	case "slack":
+		payload = slackPayload(s)
+	case "teams":
+		payload = teamsPayload(s)
+	default:
+		payload = s
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Duration(h.TimeoutSeconds) * time.Second}
+	var lastErr error
+	for attempt := 1; attempt <= h.Attempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return withoutURL(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "iis-log-compressor")
+		for k, v := range h.Headers {
+			req.Header.Set(k, v)
+		}
+		if h.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(h.Secret))
+			mac.Write(body)
+			req.Header.Set(h.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		wait := time.Duration(attempt) * 2 * time.Second
+		resp, err := client.Do(req)
+		if err != nil {
+			// The URL of a Slack or Teams webhook is its secret
+			lastErr = withoutURL(err)
+		} else {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			lastErr = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return lastErr
+			}
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 && secs <= 60 {
+				wait = time.Duration(secs) * time.Second
+			}
+		}
+		if attempt < h.Attempts {
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+		}
+	}
+	return lastErr
+}
+
+// slackEscape escapes the characters Slack treats as markup
+func slackEscape(s string) string {
+	s = strings.ReplaceAll(s, "&", "&amp;")
+	s = strings.ReplaceAll(s, "<", "&lt;")
+	return strings.ReplaceAll(s, ">", "&gt;")
+}
+
+// truncateText shortens s to at most n bytes, marking the cut
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// errorList renders the first errors or warnings as bullet lines, noting how many were left out
+func errorList(errs []string, escape func(string) string) string {
+	var b strings.Builder
+	for i, e := range errs {
+		if i == webhookMaxErrors {
+			fmt.Fprintf(&b, "... and %d more\n", len(errs)-webhookMaxErrors)
+			break
+		}
+		b.WriteString("• " + escape(e) + "\n")
+	}
+	return truncateText(b.String(), webhookMaxText)
+}
+
+// slackPayload renders the summary as a Slack Block Kit message
+func slackPayload(s *RunSummary) map[string]interface{} {
+	icon := ":white_check_mark:"
+	switch s.Status {
+	case "failed":
+		icon = ":x:"
+	case "warnings":
+		icon = ":warning:"
+	case "cancelled":
+		icon = ":no_entry_sign:"
+	}
+	var fields []map[string]interface{}
+	for _, f := range s.facts() {
+		// Slack allows at most 10 fields per section
+		if len(fields) == 10 {
+			break
+		}
+		fields = append(fields, map[string]interface{}{
+			"type": "mrkdwn",
+			"text": "*" + slackEscape(f.Title) + "*\n" + slackEscape(f.Value),
+		})
+	}
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": truncateText(s.title(), 150), "emoji": true}},
+		{"type": "section", "fields": fields},
+	}
+	if len(s.Errors) > 0 {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "*Errors*\n" + errorList(s.Errors, slackEscape)},
+		})
+	}
+	if len(s.Warnings) > 0 {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "*Warnings*\n" + errorList(s.Warnings, slackEscape)},
+		})
+	}
+	blocks = append(blocks, map[string]interface{}{
+		"type":     "context",
+		"elements": []map[string]interface{}{{"type": "mrkdwn", "text": slackEscape(s.Tool)}},
+	})
+	return map[string]interface{}{
+		"text":   icon + " " + slackEscape(s.title()),
+		"blocks": blocks,
+	}
+}
+
+// teamsPayload renders the summary as a message with an Adaptive Card, as accepted by Teams incoming
+// webhooks and Power Automate workflows
+func teamsPayload(s *RunSummary) map[string]interface{} {
+	color := "Good"
+	switch s.Status {
+	case "failed":
+		color = "Attention"
+	case "warnings", "cancelled":
+		color = "Warning"
+	}
+	var facts []map[string]interface{}
+	for _, f := range s.facts() {
+		facts = append(facts, map[string]interface{}{"title": f.Title, "value": f.Value})
+	}
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "size": "Large", "weight": "Bolder", "color": color, "text": s.title(), "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if len(s.Errors) > 0 {
+		body = append(body,
+			map[string]interface{}{"type": "TextBlock", "weight": "Bolder", "text": "Errors"},
+			map[string]interface{}{"type": "TextBlock", "color": "Attention", "wrap": true, "text": errorList(s.Errors, func(e string) string { return e })},
+		)
+	}
+	if len(s.Warnings) > 0 {
+		body = append(body,
+			map[string]interface{}{"type": "TextBlock", "weight": "Bolder", "text": "Warnings"},
+			map[string]interface{}{"type": "TextBlock", "color": "Warning", "wrap": true, "text": errorList(s.Warnings, func(e string) string { return e })},
+		)
+	}
+	body = append(body, map[string]interface{}{"type": "TextBlock", "size": "Small", "isSubtle": true, "text": s.Tool, "wrap": true})
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"contentUrl":  nil,
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRunSummary returns a failed run with one error and one warning
+func testRunSummary() *RunSummary {
+	start := time.Date(2024, 5, 3, 2, 0, 0, 0, time.UTC)
+	return &RunSummary{
+		Tool:             "iis-log-compressor test",
+		Host:             "web01",
+		Status:           "failed",
+		StartTime:        start,
+		EndTime:          start.Add(90 * time.Second),
+		DurationSeconds:  90,
+		Groups:           2,
+		FilesProcessed:   10,
+		FilesCompressed:  9,
+		BytesBefore:      1 << 30,
+		BytesAfter:       64 << 20,
+		CompressionRatio: 93.75,
+		Errors:           []string{"failed to open <u_ex240501.log> & skipped"},
+		Warnings:         []string{"could not remove u_ex240502.log"},
+	}
+}
+
+// webhookRecorder is an endpoint that answers with the given statuses in turn and records the requests
+type webhookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (h *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	h.headers = append(h.headers, r.Header.Clone())
+	h.bodies = append(h.bodies, body)
+	status := http.StatusOK
+	if n := len(h.bodies); n <= len(h.statuses) {
+		status = h.statuses[n-1]
+	}
+	if status >= 500 || status == http.StatusTooManyRequests {
+		// Keeps the retry wait of the test short
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(status)
+	if status >= 300 {
+		io.WriteString(w, "busy")
+	}
+}
+
+// testWebhook returns validated settings for a webhook posting to url
+func testWebhook(t *testing.T, h WebhookConfig) WebhookConfig {
+	t.Helper()
+	hooks := []WebhookConfig{h}
+	if err := validateWebhooks(hooks); err != nil {
+		t.Fatal(err)
+	}
+	return hooks[0]
+}
+
+func TestWebhookPayloads(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, payload map[string]interface{})
+	}{
+		{"json", func(t *testing.T, payload map[string]interface{}) {
+			if payload["status"] != "failed" || payload["host"] != "web01" || payload["files_compressed"] != float64(9) {
+				t.Errorf("summary fields missing: %v", payload)
+			}
+			if errs, _ := payload["errors"].([]interface{}); len(errs) != 1 {
+				t.Errorf("errors = %v, want one error", payload["errors"])
+			}
+		}},
+		{"slack", func(t *testing.T, payload map[string]interface{}) {
+			text, _ := payload["text"].(string)
+			if !strings.HasPrefix(text, ":x: ") {
+				t.Errorf("text = %q, want the failed icon", text)
+			}
+			blocks, _ := payload["blocks"].([]interface{})
+			if len(blocks) != 5 {
+				t.Fatalf("%d blocks, want header, facts, errors, warnings and context", len(blocks))
+			}
+			if typ := blocks[0].(map[string]interface{})["type"]; typ != "header" {
+				t.Errorf("first block is %v, want header", typ)
+			}
+			fields, _ := blocks[1].(map[string]interface{})["fields"].([]interface{})
+			if len(fields) == 0 || len(fields) > 10 {
+				t.Errorf("%d fields, want 1 to 10", len(fields))
+			}
+			errText := blocks[2].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+			if !strings.Contains(errText, "&lt;u_ex240501.log&gt; &amp; skipped") {
+				t.Errorf("error text is not escaped for Slack: %q", errText)
+			}
+		}},
+		{"teams", func(t *testing.T, payload map[string]interface{}) {
+			if payload["type"] != "message" {
+				t.Errorf("type = %v, want message", payload["type"])
+			}
+			attachments, _ := payload["attachments"].([]interface{})
+			if len(attachments) != 1 {
+				t.Fatalf("%d attachments, want 1", len(attachments))
+			}
+			a := attachments[0].(map[string]interface{})
+			if a["contentType"] != "application/vnd.microsoft.card.adaptive" {
+				t.Errorf("contentType = %v", a["contentType"])
+			}
+			card := a["content"].(map[string]interface{})
+			if card["type"] != "AdaptiveCard" {
+				t.Errorf("content type = %v, want AdaptiveCard", card["type"])
+			}
+			body := card["body"].([]interface{})
+			if color := body[0].(map[string]interface{})["color"]; color != "Attention" {
+				t.Errorf("title color = %v, want Attention", color)
+			}
+			if typ := body[1].(map[string]interface{})["type"]; typ != "FactSet" {
+				t.Errorf("second element is %v, want FactSet", typ)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rec := &webhookRecorder{}
+			srv := httptest.NewServer(rec)
+			defer srv.Close()
+			h := testWebhook(t, WebhookConfig{URL: srv.URL, Format: tt.format, Headers: map[string]string{"Authorization": "Bearer abc"}})
+			if err := sendWebhook(context.Background(), h, testRunSummary()); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if len(rec.bodies) != 1 {
+				t.Fatalf("%d requests, want 1", len(rec.bodies))
+			}
+			if got := rec.headers[0].Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if got := rec.headers[0].Get("Authorization"); got != "Bearer abc" {
+				t.Errorf("Authorization = %q, want the configured header", got)
+			}
+			if got := rec.headers[0].Get("X-IISLC-Signature-256"); got != "" {
+				t.Errorf("signature %q sent without a secret", got)
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(rec.bodies[0], &payload); err != nil {
+				t.Fatalf("payload is not JSON: %v", err)
+			}
+			tt.check(t, payload)
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"default header", "", "X-IISLC-Signature-256"},
+		{"custom header", "X-Hub-Signature-256", "X-Hub-Signature-256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &webhookRecorder{}
+			srv := httptest.NewServer(rec)
+			defer srv.Close()
+			h := testWebhook(t, WebhookConfig{URL: srv.URL, Secret: "s3cr3t", SignatureHeader: tt.header})
+			if err := sendWebhook(context.Background(), h, testRunSummary()); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			mac.Write(rec.bodies[0])
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if got := rec.headers[0].Get(tt.want); got != want {
+				t.Errorf("%s = %q, want %q", tt.want, got, want)
+			}
+		})
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		wantErr  string
+		wantHits int
+	}{
+		{"retry after 503", []int{http.StatusServiceUnavailable}, 3, "", 2},
+		{"retry after 429", []int{http.StatusTooManyRequests}, 3, "", 2},
+		{"give up after the last attempt", []int{502, 502}, 2, "502 Bad Gateway: busy", 2},
+		{"no retry after 400", []int{http.StatusBadRequest}, 3, "400 Bad Request: busy", 1},
+		{"no retry after 404", []int{http.StatusNotFound}, 3, "404 Not Found: busy", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &webhookRecorder{statuses: tt.statuses}
+			srv := httptest.NewServer(rec)
+			defer srv.Close()
+			h := testWebhook(t, WebhookConfig{URL: srv.URL, Attempts: tt.attempts})
+			err := sendWebhook(context.Background(), h, testRunSummary())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("send: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+			if len(rec.bodies) != tt.wantHits {
+				t.Errorf("%d requests, want %d", len(rec.bodies), tt.wantHits)
+			}
+			for i := 1; i < len(rec.bodies); i++ {
+				if string(rec.bodies[i]) != string(rec.bodies[0]) {
+					t.Errorf("attempt %d sent a different body", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookCancelledDuringRetryWait(t *testing.T) {
+	rec := &webhookRecorder{statuses: []int{http.StatusServiceUnavailable}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	h := testWebhook(t, WebhookConfig{URL: srv.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := sendWebhook(ctx, h, testRunSummary()); err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(rec.bodies) != 1 {
+		t.Errorf("%d requests, want 1", len(rec.bodies))
+	}
+}
+
+func TestWebhookErrorHidesURL(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // refuse connections
+	h := testWebhook(t, WebhookConfig{URL: srv.URL + "/services/T000/B000/XXXXSECRET", Format: "slack", Attempts: 1})
+	err := sendWebhook(context.Background(), h, testRunSummary())
+	if err == nil {
+		t.Fatal("post to a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "XXXXSECRET") {
+		t.Errorf("error %q contains the webhook URL", err)
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	hooks := []WebhookConfig{{URL: "https://example.com/hook", Format: " Slack "}}
+	if err := validateWebhooks(hooks); err != nil {
+		t.Fatal(err)
+	}
+	h := hooks[0]
+	if h.Format != "slack" || h.Name != "slack" || h.SignatureHeader != "X-IISLC-Signature-256" || h.Attempts != 3 || h.TimeoutSeconds != 15 {
+		t.Errorf("defaults not applied: %+v", h)
+	}
+	for _, bad := range []WebhookConfig{{}, {URL: "https://example.com", Format: "discord"}} {
+		if err := validateWebhooks([]WebhookConfig{bad}); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}